@@ -1,7 +1,19 @@
 package kgo
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 	"unsafe"
 )
@@ -64,6 +76,25 @@ func (a RecordAttrs) IsControl() bool {
 	return a.attrs&0b0010_0000 != 0
 }
 
+// Is returns whether the record was compressed with the given codec's
+// algorithm. The codec's level is ignored. For example, to check if a record
+// was compressed with zstd:
+//
+//	r.Attrs.Is(ZstdCompression())
+func (a RecordAttrs) Is(codec CompressionCodec) bool {
+	return a.CompressionType() == uint8(codec.codec)
+}
+
+// Raw returns the raw attributes byte, which follows Kafka's record batch
+// attributes bit layout (compression in bits 1 thru 3, timestamp type in bit
+// 4, transactional in bit 5, control in bit 6).
+//
+// The high bit is not a Kafka bit: the client sets it for records from
+// message sets that have no timestamp (see TimestampType).
+func (a RecordAttrs) Raw() uint8 {
+	return a.attrs
+}
+
 // Record is a record to write to Kafka.
 type Record struct {
 	// Key is an optional field that can be used for partition assignment.
@@ -143,13 +174,9 @@ type Record struct {
 // be used if you only ever read record fields. This function can safely be used
 // for producing; the client never modifies a record's key nor value fields.
 func StringRecord(value string) *Record {
-	var slice []byte
-	slicehdr := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-	slicehdr.Data = ((*reflect.StringHeader)(unsafe.Pointer(&value))).Data
-	slicehdr.Len = len(value)
-	slicehdr.Cap = len(value)
-
-	return &Record{Value: slice}
+	r := new(Record)
+	r.SetValueString(value)
+	return r
 }
 
 // KeyStringRecord returns a Record with the Key and Value fields set to the
@@ -163,13 +190,35 @@ func StringRecord(value string) *Record {
 // for producing; the client never modifies a record's key nor value fields.
 func KeyStringRecord(key, value string) *Record {
 	r := StringRecord(value)
+	r.SetKeyString(key)
+	return r
+}
+
+// SetValueString sets the record's Value field to the input value string,
+// which is useful for reusing one record across many produces.
+//
+// This function uses the 'unsafe' package to avoid copying value into a slice.
+//
+// NOTE: It is NOT SAFE to modify the record's value. This function should only
+// be used if you only ever read record fields. This function can safely be used
+// for producing; the client never modifies a record's key nor value fields.
+// As well, a record must not be reused until the client is done with it
+// (i.e., until its produce promise is called).
+func (r *Record) SetValueString(value string) {
+	valuehdr := (*reflect.SliceHeader)(unsafe.Pointer(&r.Value))
+	valuehdr.Data = ((*reflect.StringHeader)(unsafe.Pointer(&value))).Data
+	valuehdr.Len = len(value)
+	valuehdr.Cap = len(value)
+}
 
+// SetKeyString sets the record's Key field to the input key string.
+//
+// This has the same 'unsafe' caveats as SetValueString.
+func (r *Record) SetKeyString(key string) {
 	keyhdr := (*reflect.SliceHeader)(unsafe.Pointer(&r.Key))
 	keyhdr.Data = ((*reflect.StringHeader)(unsafe.Pointer(&key))).Data
 	keyhdr.Len = len(key)
 	keyhdr.Cap = len(key)
-
-	return r
 }
 
 // SliceRecord returns a Record with the Value field set to the input value
@@ -186,6 +235,319 @@ func KeySliceRecord(key, value []byte) *Record {
 	return &Record{Key: key, Value: value}
 }
 
+// WithTopic returns a shallow copy of the record with the Topic field set to
+// the input topic. This is useful for producing one prototype record to many
+// topics.
+//
+// NOTE: The returned record shares the Key, Value, and Headers of the
+// original. It is NOT SAFE to modify these fields in either record while the
+// other is in use, nor to produce the original concurrently while modifying
+// it. The client never modifies a record's key nor value fields.
+func (r *Record) WithTopic(topic string) *Record {
+	cp := *r
+	cp.Topic = topic
+	return &cp
+}
+
+// WithPartition returns a shallow copy of the record with the Partition field
+// set to the input partition.
+//
+// This has the same aliasing caveats as WithTopic.
+func (r *Record) WithPartition(partition int32) *Record {
+	cp := *r
+	cp.Partition = partition
+	return &cp
+}
+
+// HeaderInt returns the value of the given header key decoded as a
+// big-endian, two's complement signed integer. The value must be 1, 2, 4, or
+// 8 bytes long; this returns false if the header does not exist or the value
+// is any other length. If the key is duplicated, the last value is used, the
+// same as HeaderMap.
+func (r *Record) HeaderInt(key string) (int64, bool) {
+	v, ok := r.lastHeader(key)
+	if !ok {
+		return 0, false
+	}
+	switch len(v) {
+	case 1:
+		return int64(int8(v[0])), true
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(v))), true
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(v))), true
+	case 8:
+		return int64(binary.BigEndian.Uint64(v)), true
+	}
+	return 0, false
+}
+
+// HeaderString returns the value of the given header key as a string, or
+// false if the header does not exist. If the key is duplicated, the last
+// value is used, the same as HeaderMap.
+func (r *Record) HeaderString(key string) (string, bool) {
+	v, ok := r.lastHeader(key)
+	return string(v), ok
+}
+
+// lastHeader returns the last value for the given header key.
+func (r *Record) lastHeader(key string) ([]byte, bool) {
+	for i := len(r.Headers) - 1; i >= 0; i-- {
+		if r.Headers[i].Key == key {
+			return r.Headers[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// IsTombstone returns whether the record is a tombstone, that is, whether its
+// Value is nil.
+//
+// Kafka distinguishes a nil value from an empty value: a nil value is a
+// delete marker for the record's key in compacted topics, whereas a non-nil,
+// zero length value is a regular record with an empty value. This only
+// returns true for nil values.
+func (r *Record) IsTombstone() bool {
+	return r.Value == nil
+}
+
+// HeaderMap returns the record's headers as a map of header key to value.
+//
+// Kafka allows duplicate header keys. If a key is duplicated, the last value
+// for that key wins; use HeaderValues to get all values for a key. If the
+// record has no headers, this returns an empty, non-nil map.
+func (r *Record) HeaderMap() map[string][]byte {
+	m := make(map[string][]byte, len(r.Headers))
+	for _, h := range r.Headers {
+		m[h.Key] = h.Value
+	}
+	return m
+}
+
+// HeaderValues returns all values for the given header key, in the order
+// they appear in the record's headers, or nil if the key is not present.
+func (r *Record) HeaderValues(key string) [][]byte {
+	var values [][]byte
+	for _, h := range r.Headers {
+		if h.Key == key {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+// ApproxSize returns the approximate size of the record's payload: the
+// length of the key, value, and all header keys and values.
+//
+// This does not account for the per-record framing Kafka uses (varint
+// lengths, timestamp and offset deltas, attributes), nor for batch overhead
+// or compression, so it is an estimate of the uncompressed user data in the
+// record rather than the number of bytes fetched or produced.
+func (r *Record) ApproxSize() int64 {
+	return int64(len(r.Key) + len(r.Value) + r.headersSize())
+}
+
+// clone returns a deep copy of the record: the key, value, and headers are
+// copied into fresh slices. Nil slices remain nil.
+func (r *Record) clone() *Record {
+	cp := *r
+	if r.Key != nil {
+		cp.Key = append([]byte{}, r.Key...)
+	}
+	if r.Value != nil {
+		cp.Value = append([]byte{}, r.Value...)
+	}
+	if r.Headers != nil {
+		cp.Headers = make([]RecordHeader, len(r.Headers))
+		for i, h := range r.Headers {
+			cp.Headers[i].Key = h.Key
+			if h.Value != nil {
+				cp.Headers[i].Value = append([]byte{}, h.Value...)
+			}
+		}
+	}
+	return &cp
+}
+
+// ContentHash returns a 64 bit FNV-1a hash of the record's key, value, and
+// headers, which is useful for deduplicating or sharding records by content.
+// This hash is not cryptographically secure.
+//
+// Headers are sorted by key and then value before hashing, so the hash does
+// not depend on header order. Every field is length prefixed and nil slices
+// hash differently than empty slices, so a tombstone does not collide with an
+// empty value. Fields other than the key, value, and headers (topic,
+// partition, offset, timestamp, etc.) are not included.
+func (r *Record) ContentHash() uint64 {
+	h := fnv.New64a()
+	hashBytes(h, r.Key)
+	hashBytes(h, r.Value)
+
+	headers := append([]RecordHeader(nil), r.Headers...)
+	sort.Slice(headers, func(i, j int) bool {
+		l, r := &headers[i], &headers[j]
+		return l.Key < r.Key || l.Key == r.Key && bytes.Compare(l.Value, r.Value) < 0
+	})
+	for _, header := range headers {
+		hashBytes(h, []byte(header.Key))
+		hashBytes(h, header.Value)
+	}
+	return h.Sum64()
+}
+
+// PayloadEqual returns whether the record has the same key, value, and
+// headers (in the same order) as other. All other fields, such as the topic,
+// partition, offset, timestamp, and producer and leader metadata, are
+// ignored. This is useful to check that a consumed record carries the same
+// payload as a record that was produced.
+//
+// As with ContentHash, nil slices are not equal to empty slices, so a
+// tombstone is not equal to a record with an empty value.
+func (r *Record) PayloadEqual(other *Record) bool {
+	if !nilAwareEqual(r.Key, other.Key) ||
+		!nilAwareEqual(r.Value, other.Value) ||
+		len(r.Headers) != len(other.Headers) {
+		return false
+	}
+	for i, h := range r.Headers {
+		oh := other.Headers[i]
+		if h.Key != oh.Key || !nilAwareEqual(h.Value, oh.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// nilAwareEqual is bytes.Equal, but a nil slice does not equal an empty one.
+func nilAwareEqual(l, r []byte) bool {
+	return (l == nil) == (r == nil) && bytes.Equal(l, r)
+}
+
+// hashBytes writes the length of b (-1 if b is nil) and then b to h.
+func hashBytes(h hash.Hash64, b []byte) {
+	var length [8]byte
+	n := int64(len(b))
+	if b == nil {
+		n = -1
+	}
+	binary.BigEndian.PutUint64(length[:], uint64(n))
+	h.Write(length[:])
+	h.Write(b)
+}
+
+// Age returns how long before now the record was timestamped.
+//
+// For topics using LogAppendTime, this measures the latency from the broker
+// writing the record to now; for topics using CreateTime, this measures the
+// latency from the producer creating the record to now. If the record has no
+// timestamp (pre 0.10.0 message sets), this returns -1. Note that if
+// producer clocks are skewed, the age of CreateTime records can be negative.
+func (r *Record) Age(now time.Time) time.Duration {
+	if r.Attrs.TimestampType() < 0 {
+		return -1
+	}
+	return now.Sub(r.Timestamp)
+}
+
+// MaxValidateRecordBytes is the maximum Record.ApproxSize that Record.Validate
+// allows. This defaults to 1MiB, which is roughly Kafka's default maximum
+// message size, and can be changed if your brokers allow larger records.
+var MaxValidateRecordBytes int64 = 1 << 20
+
+// Validate returns an error if the record is obviously invalid for producing:
+// if the record has no topic, if the record's key, value, and headers are
+// larger than MaxValidateRecordBytes, or if any header has an empty key.
+//
+// This is a cheap local check to fail fast; a record that passes validation
+// can still be rejected by Kafka.
+func (r *Record) Validate() error {
+	if r.Topic == "" {
+		return errors.New("invalid record: no topic set")
+	}
+	if size := r.ApproxSize(); size > MaxValidateRecordBytes {
+		return fmt.Errorf("invalid record: size %d is larger than the max %d", size, MaxValidateRecordBytes)
+	}
+	for i, h := range r.Headers {
+		if h.Key == "" {
+			return fmt.Errorf("invalid record: header %d has an empty key", i)
+		}
+	}
+	return nil
+}
+
+// headersSize returns the total number of bytes in the record's header keys
+// and values.
+func (r *Record) headersSize() int {
+	var size int
+	for _, h := range r.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
+}
+
+// RecordFields is a flattened view of a record's user facing fields, useful
+// for struct based encoders (CSV, columnar formats, etc.).
+type RecordFields struct {
+	Topic      string
+	Partition  int32
+	Offset     int64
+	Timestamp  time.Time
+	KeyBytes   []byte
+	ValueBytes []byte
+
+	// Headers maps each header key to all values for that key, in the
+	// order the values appeared in the record.
+	Headers map[string][][]byte
+}
+
+// Fields returns the record's fields flattened into a RecordFields. The key,
+// value, and header values are not copied.
+func (r *Record) Fields() RecordFields {
+	rf := RecordFields{
+		Topic:      r.Topic,
+		Partition:  r.Partition,
+		Offset:     r.Offset,
+		Timestamp:  r.Timestamp,
+		KeyBytes:   r.Key,
+		ValueBytes: r.Value,
+		Headers:    make(map[string][][]byte, len(r.Headers)),
+	}
+	for _, h := range r.Headers {
+		rf.Headers[h.Key] = append(rf.Headers[h.Key], h.Value)
+	}
+	return rf
+}
+
+// ToRecord returns a record from the flattened fields. The key, value, and
+// header values are not copied.
+//
+// Converting a record to RecordFields and back is lossless for the topic,
+// partition, offset, timestamp, key, value, and header values, with one
+// caveat: headers are ordered by key, so the relative order of headers with
+// different keys is not preserved. Fields that RecordFields does not have
+// (attrs, producer ID and epoch, leader epoch) are left zero.
+func (rf RecordFields) ToRecord() *Record {
+	r := &Record{
+		Key:       rf.KeyBytes,
+		Value:     rf.ValueBytes,
+		Timestamp: rf.Timestamp,
+		Topic:     rf.Topic,
+		Partition: rf.Partition,
+		Offset:    rf.Offset,
+	}
+	keys := make([]string, 0, len(rf.Headers))
+	for key := range rf.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range rf.Headers[key] {
+			r.Headers = append(r.Headers, RecordHeader{key, value})
+		}
+	}
+	return r
+}
+
 // FetchPartition is a response for a partition in a fetched topic from a
 // broker.
 type FetchPartition struct {
@@ -213,6 +575,195 @@ type FetchPartition struct {
 	Records []*Record
 }
 
+// CheckOffsetsMonotonic returns whether the partition's records are in
+// strictly increasing offset order. If they are not, this returns the index
+// of the first record whose offset is not greater than the offset of the
+// record before it. If they are, this returns -1 and true.
+//
+// Records in a partition should always be strictly increasing; this function
+// exists to sanity check that in tests or debug builds.
+func (p FetchPartition) CheckOffsetsMonotonic() (firstBadIndex int, ok bool) {
+	for i := 1; i < len(p.Records); i++ {
+		if p.Records[i].Offset <= p.Records[i-1].Offset {
+			return i, false
+		}
+	}
+	return -1, true
+}
+
+// IncludesHWM returns whether the partition's records include the record just
+// before the high watermark, that is, whether this fetch read up to the end
+// of the partition.
+//
+// This returns false if the partition has no records.
+func (p FetchPartition) IncludesHWM() bool {
+	// Records are in offset order, so we search from the back and quit
+	// once we are before the high watermark's record.
+	for i := len(p.Records) - 1; i >= 0; i-- {
+		switch offset := p.Records[i].Offset; {
+		case offset == p.HighWatermark-1:
+			return true
+		case offset < p.HighWatermark-1:
+			return false
+		}
+	}
+	return false
+}
+
+// RecordAtOffset returns the record at the given offset in this partition, if
+// it exists.
+//
+// If the partition's offsets are contiguous, the record is indexed directly
+// using the first record's offset as a base. If there are gaps (e.g., from
+// compaction or transaction markers), this falls back to a binary search over
+// the records, which are always in offset order.
+func (p FetchPartition) RecordAtOffset(offset int64) (*Record, bool) {
+	idx := p.searchOffset(offset)
+	if idx < len(p.Records) && p.Records[idx].Offset == offset {
+		return p.Records[idx], true
+	}
+	return nil, false
+}
+
+// TrimToOffset returns a copy of the partition whose records begin at the
+// first record with an offset at or after the given offset. All other fields
+// are unchanged. This is useful for dropping records that were already
+// processed, such as after re-receiving records following a rebalance.
+//
+// The returned partition's records alias the original partition's records.
+// Records are assumed to be in offset order, which they always are when
+// fetched; gaps in offsets (e.g., from compaction) are handled the same as in
+// RecordAtOffset.
+func (p FetchPartition) TrimToOffset(offset int64) FetchPartition {
+	p.Records = p.Records[p.searchOffset(offset):]
+	return p
+}
+
+// RecordsInRange returns the records in this partition with offsets in the
+// range [lo, hi). Offsets in the range that have no record (e.g., from
+// compaction) are simply not present. If no records are in the range, or if
+// lo >= hi, this returns an empty slice.
+//
+// Because records are in offset order, the returned records are always a
+// subslice of the partition's records and share its backing array. The
+// returned slice's capacity is capped, so appending to it does not modify the
+// partition's records.
+func (p FetchPartition) RecordsInRange(lo, hi int64) []*Record {
+	if lo >= hi {
+		return p.Records[:0:0]
+	}
+	start, end := p.searchOffset(lo), p.searchOffset(hi)
+	return p.Records[start:end:end]
+}
+
+// searchOffset returns the index of the first record at or after offset, or
+// len(p.Records) if there is no such record.
+func (p FetchPartition) searchOffset(offset int64) int {
+	if len(p.Records) == 0 {
+		return 0
+	}
+	if idx := offset - p.Records[0].Offset; idx >= 0 && idx < int64(len(p.Records)) && p.Records[idx].Offset == offset {
+		return int(idx)
+	}
+	return sort.Search(len(p.Records), func(i int) bool { return p.Records[i].Offset >= offset })
+}
+
+// Tombstones returns the records in this partition that are tombstones, as
+// defined by Record.IsTombstone, in offset order.
+func (p FetchPartition) Tombstones() []*Record {
+	var tombstones []*Record
+	for _, r := range p.Records {
+		if r.IsTombstone() {
+			tombstones = append(tombstones, r)
+		}
+	}
+	return tombstones
+}
+
+// LeaderEpochChanges returns the indices of records in this partition whose
+// leader epoch differs from the record before it. A change in leader epoch
+// means the partition's leadership changed between writing the two records.
+//
+// Records from old message sets have a leader epoch of -1. A transition into
+// or out of -1 is reported as a change like any other, which generally
+// corresponds to a message format upgrade rather than a leadership change.
+// The first record is never reported.
+func (p FetchPartition) LeaderEpochChanges() []int {
+	var changes []int
+	for i := 1; i < len(p.Records); i++ {
+		if p.Records[i].LeaderEpoch != p.Records[i-1].LeaderEpoch {
+			changes = append(changes, i)
+		}
+	}
+	return changes
+}
+
+// SortedByTimestamp returns a new slice of this partition's records sorted
+// by timestamp, oldest first. The sort is stable, so records with equal
+// timestamps remain in offset order. Records with no timestamp (pre 0.10.0
+// message sets) are sorted before all records with timestamps.
+//
+// The partition's Records slice is not modified.
+func (p FetchPartition) SortedByTimestamp() []*Record {
+	sorted := append([]*Record(nil), p.Records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		l, r := sorted[i], sorted[j]
+		lnone, rnone := l.Attrs.TimestampType() < 0, r.Attrs.TimestampType() < 0
+		if lnone || rnone {
+			return lnone && !rnone
+		}
+		return l.Timestamp.Before(r.Timestamp)
+	})
+	return sorted
+}
+
+// LSOGap returns the partition's HighWatermark minus its LastStableOffset,
+// which is the number of offsets that are not yet decided because they are
+// part of open transactions.
+//
+// The LastStableOffset is only known when fetching with v4+ fetch requests;
+// otherwise it is -1. If the LastStableOffset is unknown, this returns 0.
+func (p FetchPartition) LSOGap() int64 {
+	if p.LastStableOffset < 0 {
+		return 0
+	}
+	return p.HighWatermark - p.LastStableOffset
+}
+
+// DominantCodec returns the compression codec of this partition's records if
+// every record was compressed with the same codec, or false if the records
+// use a mix of codecs. A mix of codecs generally means the partition has
+// batches from producers using different compression settings.
+//
+// The returned codec is the codec's default, as returned from the codec's
+// constructor (e.g., ZstdCompression()); compression levels are not known
+// when consuming. If the partition has no records, or if the codec is
+// unknown, this returns NoCompression() and false.
+func (p FetchPartition) DominantCodec() (CompressionCodec, bool) {
+	if len(p.Records) == 0 {
+		return NoCompression(), false
+	}
+	typ := p.Records[0].Attrs.CompressionType()
+	for _, r := range p.Records[1:] {
+		if r.Attrs.CompressionType() != typ {
+			return NoCompression(), false
+		}
+	}
+	switch typ {
+	case 0:
+		return NoCompression(), true
+	case 1:
+		return GzipCompression(), true
+	case 2:
+		return SnappyCompression(), true
+	case 3:
+		return Lz4Compression(), true
+	case 4:
+		return ZstdCompression(), true
+	}
+	return NoCompression(), false
+}
+
 // FetchTopic is a response for a fetched topic from a broker.
 type FetchTopic struct {
 	// Topic is the topic this is for.
@@ -231,6 +782,38 @@ type Fetch struct {
 // Fetches is a group of fetches from brokers.
 type Fetches []Fetch
 
+// TopicPartition is a topic and partition pair, used to key per-partition
+// results across all topics in a Fetches.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// PendingTransactionGap returns the difference between the high watermark and
+// the last stable offset for every partition in the fetches.
+//
+// This gap is the number of offsets that are not yet "decided", which is
+// generally from transactions that are not yet committed or aborted. A large
+// gap indicates many records are stuck in open transactions.
+//
+// Partitions with an error and no records are skipped: the client injects
+// these for errors such as data loss or auth failures, and they do not have
+// valid watermarks. A partition that errored partway through parsing a
+// response still has the watermarks the broker sent and is included.
+// Partitions with an unknown last stable offset (negative, which is the case
+// when fetching with requests older than v4) are also skipped. If a partition
+// is in the fetches multiple times, the last occurrence wins.
+func (fs Fetches) PendingTransactionGap() map[TopicPartition]int64 {
+	gaps := make(map[TopicPartition]int64)
+	fs.EachPartition(func(p FetchTopicPartition) {
+		if p.Partition.Err != nil && len(p.Partition.Records) == 0 || p.Partition.LastStableOffset < 0 {
+			return
+		}
+		gaps[TopicPartition{p.Topic, p.Partition.Partition}] = p.Partition.LSOGap()
+	})
+	return gaps
+}
+
 // FetchError is an error in a fetch along with the topic and partition that
 // the error was on.
 type FetchError struct {
@@ -239,6 +822,59 @@ type FetchError struct {
 	Err       error
 }
 
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("topic %s partition %d: %v", e.Topic, e.Partition, e.Err)
+}
+
+// Unwrap returns the underlying partition error.
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// Err returns all partition errors in Fetches as a single error, or nil if
+// there are no errors.
+//
+// If one partition has an error, this returns a *FetchError, which wraps the
+// partition error with its topic and partition. If multiple partitions have
+// errors, this returns an error that wraps a *FetchError for each partition.
+// The returned error implements Unwrap() []error, meaning errors.Is and
+// errors.As (with Go 1.20+) check every partition error.
+func (fs Fetches) Err() error {
+	var errs fetchErrors
+	fs.EachErr(func(t string, p int32, err error) {
+		errs = append(errs, &FetchError{t, p, err})
+	})
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
+// fetchErrors is returned from Fetches.Err if many partitions have errors.
+type fetchErrors []*FetchError
+
+func (es fetchErrors) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d partitions had fetch errors: ", len(es))
+	for i, e := range es {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(e.Error())
+	}
+	return sb.String()
+}
+
+func (es fetchErrors) Unwrap() []error {
+	errs := make([]error, len(es))
+	for i, e := range es {
+		errs[i] = e
+	}
+	return errs
+}
+
 // Errors returns all errors in a fetch with the topic and partition that
 // errored.
 //
@@ -293,12 +929,48 @@ func (fs Fetches) RecordIter() *FetchesRecordIter {
 	return iter
 }
 
+// RecordIterStopOnErr returns an iterator over all records in a fetch that
+// stops at the first partition with an error.
+//
+// Records are visited in the same order as RecordIter: fetch by fetch, topic
+// by topic within a fetch, and partition by partition within a topic. Every
+// record in partitions before the first errored partition is returned. Once
+// the iterator reaches a partition with a non-nil Err, the iterator is done:
+// no records from the errored partition nor any later partition are
+// returned. This is useful to avoid processing past a gap caused by, for
+// example, a batch parse failure.
+func (fs Fetches) RecordIterStopOnErr() *FetchesRecordIter {
+	iter := &FetchesRecordIter{fetches: fs, stopOnErr: true}
+	iter.prepareNext()
+	return iter
+}
+
+// RecordIterSince returns an iterator over all records in a fetch that skips
+// records timestamped before cutoff. Records with no timestamp (pre 0.10.0
+// message sets) are also skipped.
+//
+// Records are otherwise visited in the same order as RecordIter, and Done
+// returns true once all remaining records are before the cutoff.
+func (fs Fetches) RecordIterSince(cutoff time.Time) *FetchesRecordIter {
+	iter := &FetchesRecordIter{
+		fetches: fs,
+		skip: func(r *Record) bool {
+			return r.Attrs.TimestampType() < 0 || r.Timestamp.Before(cutoff)
+		},
+	}
+	iter.prepareNext()
+	return iter
+}
+
 // FetchesRecordIter iterates over records in a fetch.
 type FetchesRecordIter struct {
 	fetches []Fetch
 	ti      int // index to current topic in fetches[0]
 	pi      int // index to current partition in current topic
 	ri      int // index to current record in current partition
+
+	stopOnErr bool               // if true, the iterator is done at the first errored partition
+	skip      func(*Record) bool // if non-nil, records this returns true for are skipped
 }
 
 // Done returns whether there are any more records to iterate over.
@@ -308,12 +980,61 @@ func (i *FetchesRecordIter) Done() bool {
 
 // Next returns the next record from a fetch.
 func (i *FetchesRecordIter) Next() *Record {
-	next := i.fetches[0].Topics[i.ti].Partitions[i.pi].Records[i.ri]
+	next := i.peek()
 	i.ri++
 	i.prepareNext()
 	return next
 }
 
+// Collect returns all remaining records in the iterator, leaving the
+// iterator done. Calling Collect on a done iterator returns an empty slice.
+//
+// For iterators from RecordIter, the returned slice is pre-sized to the
+// number of remaining records.
+func (i *FetchesRecordIter) Collect() []*Record {
+	var records []*Record
+	if !i.stopOnErr && i.skip == nil {
+		records = make([]*Record, 0, i.remaining())
+	} else {
+		records = make([]*Record, 0)
+	}
+	for !i.Done() {
+		records = append(records, i.Next())
+	}
+	return records
+}
+
+// remaining returns the number of records remaining in the iterator,
+// ignoring stopOnErr and skip.
+func (i *FetchesRecordIter) remaining() int {
+	var n int
+	for fi := range i.fetches {
+		topics := i.fetches[fi].Topics
+		for ti := range topics {
+			if fi == 0 && ti < i.ti {
+				continue
+			}
+			partitions := topics[ti].Partitions
+			for pi := range partitions {
+				current := fi == 0 && ti == i.ti
+				if current && pi < i.pi {
+					continue
+				}
+				n += len(partitions[pi].Records)
+				if current && pi == i.pi {
+					n -= i.ri
+				}
+			}
+		}
+	}
+	return n
+}
+
+// peek returns the next record without advancing the iterator.
+func (i *FetchesRecordIter) peek() *Record {
+	return i.fetches[0].Topics[i.ti].Partitions[i.pi].Records[i.ri]
+}
+
 func (i *FetchesRecordIter) prepareNext() {
 beforeFetch0:
 	if len(i.fetches) == 0 {
@@ -337,11 +1058,47 @@ beforePartition:
 	}
 
 	partition := &topic.Partitions[i.pi]
+	if i.stopOnErr && partition.Err != nil {
+		i.fetches = nil
+		return
+	}
 	if i.ri >= len(partition.Records) {
 		i.pi++
 		i.ri = 0
 		goto beforePartition
 	}
+	if i.skip != nil && i.skip(partition.Records[i.ri]) {
+		i.ri++
+		goto beforePartition
+	}
+}
+
+// RecordIterWithPartition returns an iterator over all records in a fetch
+// that also returns the partition each record was fetched in.
+//
+// This iterates in the same order as RecordIter, and is useful if you need a
+// record's partition watermarks or error while processing the record.
+func (fs Fetches) RecordIterWithPartition() *FetchesPartitionRecordIter {
+	return &FetchesPartitionRecordIter{*fs.RecordIter()}
+}
+
+// FetchesPartitionRecordIter iterates over records in a fetch, returning each
+// record alongside the partition it is from.
+type FetchesPartitionRecordIter struct {
+	iter FetchesRecordIter
+}
+
+// Done returns whether there are any more records to iterate over.
+func (i *FetchesPartitionRecordIter) Done() bool {
+	return i.iter.Done()
+}
+
+// Next returns the next record from a fetch and the partition that record is
+// from. The returned partition points into the original Fetches and should
+// not be modified.
+func (i *FetchesPartitionRecordIter) Next() (*Record, *FetchPartition) {
+	partition := &i.iter.fetches[0].Topics[i.iter.ti].Partitions[i.iter.pi]
+	return i.iter.Next(), partition
 }
 
 // EachPartition calls fn for each partition in Fetches.
@@ -417,3 +1174,1065 @@ func (r *FetchTopicPartition) EachRecord(fn func(*Record)) {
 		fn(r)
 	}
 }
+
+// TopNByTime returns up to the n records with the newest timestamps across all
+// fetches, sorted newest first.
+//
+// Records with no timestamp (pre 0.10.0 message sets, see
+// RecordAttrs.TimestampType) are skipped. This uses a heap bounded to n
+// records, rather than sorting all records.
+func (fs Fetches) TopNByTime(n int) []*Record {
+	if n <= 0 {
+		return nil
+	}
+	h := make(recordTimeHeap, 0, n)
+	fs.EachRecord(func(r *Record) {
+		switch {
+		case r.Attrs.TimestampType() < 0:
+		case len(h) < n:
+			heap.Push(&h, r)
+		case r.Timestamp.After(h[0].Timestamp):
+			h[0] = r
+			heap.Fix(&h, 0)
+		}
+	})
+	newest := make([]*Record, len(h))
+	for i := len(newest) - 1; i >= 0; i-- {
+		newest[i] = heap.Pop(&h).(*Record)
+	}
+	return newest
+}
+
+// recordTimeHeap is a min heap of records by timestamp.
+type recordTimeHeap []*Record
+
+func (h recordTimeHeap) Len() int            { return len(h) }
+func (h recordTimeHeap) Less(i, j int) bool  { return h[i].Timestamp.Before(h[j].Timestamp) }
+func (h recordTimeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordTimeHeap) Push(x interface{}) { *h = append(*h, x.(*Record)) }
+func (h *recordTimeHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// EachRecordN calls fn for up to n records in Fetches, in the same order as
+// RecordIter, returning how many records were processed and whether any
+// records remain unvisited.
+//
+// If n is not positive, no records are processed and more is true if the
+// fetches have any records.
+func (fs Fetches) EachRecordN(n int, fn func(*Record)) (processed int, more bool) {
+	iter := fs.RecordIter()
+	for ; processed < n && !iter.Done(); processed++ {
+		fn(iter.Next())
+	}
+	return processed, !iter.Done()
+}
+
+// ToCommit returns the offsets to commit for all records in Fetches, in the
+// same form that CommitOffsets and BlockingCommitOffsets expect.
+//
+// For each partition with records, the offset is one past the partition's
+// highest record offset (i.e., maxRecordOffset+1), and the epoch is that
+// record's leader epoch. This is the same offset the client tracks as
+// uncommitted when autocommitting. Partitions with no records are not
+// included.
+func (fs Fetches) ToCommit() map[string]map[int32]EpochOffset {
+	offsets := make(map[string]map[int32]EpochOffset)
+	fs.EachPartition(func(p FetchTopicPartition) {
+		if len(p.Partition.Records) == 0 {
+			return
+		}
+		final := p.Partition.Records[len(p.Partition.Records)-1]
+		topicOffsets := offsets[p.Topic]
+		if topicOffsets == nil {
+			topicOffsets = make(map[int32]EpochOffset)
+			offsets[p.Topic] = topicOffsets
+		}
+		if existing, exists := topicOffsets[p.Partition.Partition]; exists && existing.Offset > final.Offset {
+			return
+		}
+		topicOffsets[p.Partition.Partition] = EpochOffset{
+			final.LeaderEpoch, // -1 if old message / unknown
+			final.Offset + 1,
+		}
+	})
+	return offsets
+}
+
+// RecordsWithLargeHeaders returns all records, in the same order as
+// RecordIter, whose total header bytes exceed maxBytes. A record's header
+// bytes are the sum of the lengths of all header keys and values.
+func (fs Fetches) RecordsWithLargeHeaders(maxBytes int) []*Record {
+	var large []*Record
+	fs.EachRecord(func(r *Record) {
+		if r.headersSize() > maxBytes {
+			large = append(large, r)
+		}
+	})
+	return large
+}
+
+// TopicStat contains aggregate counts for a topic in Fetches.
+type TopicStat struct {
+	// Records is the number of records for this topic.
+	Records int
+	// Bytes is the sum of Record.ApproxSize for all records in this topic.
+	Bytes int64
+	// Partitions is the number of distinct partitions for this topic,
+	// including partitions that had no records.
+	Partitions int
+}
+
+// TopicStats returns record counts, approximate byte totals, and partition
+// counts per topic, computed in one pass over all fetches.
+//
+// Byte totals use Record.ApproxSize; see that function's documentation for
+// what the estimate does and does not include.
+func (fs Fetches) TopicStats() map[string]TopicStat {
+	stats := make(map[string]TopicStat)
+	seen := make(map[TopicPartition]struct{})
+	fs.EachPartition(func(p FetchTopicPartition) {
+		stat := stats[p.Topic]
+		tp := TopicPartition{p.Topic, p.Partition.Partition}
+		if _, exists := seen[tp]; !exists {
+			seen[tp] = struct{}{}
+			stat.Partitions++
+		}
+		stat.Records += len(p.Partition.Records)
+		for _, r := range p.Partition.Records {
+			stat.Bytes += r.ApproxSize()
+		}
+		stats[p.Topic] = stat
+	})
+	return stats
+}
+
+// NumRecords returns the total number of records across all fetched
+// partitions.
+func (fs Fetches) NumRecords() int {
+	var n int
+	fs.EachPartition(func(p FetchTopicPartition) {
+		n += len(p.Partition.Records)
+	})
+	return n
+}
+
+// Partition calls fn for every record and splits the records into those that
+// fn returned true for (good) and false for (bad). Both slices preserve the
+// order of RecordIter.
+//
+// This has nothing to do with Kafka partitions; it partitions the records
+// into two groups, which is useful for separating records that pass and fail
+// validation in one pass.
+func (fs Fetches) Partition(fn func(*Record) bool) (good, bad []*Record) {
+	// We allocate once: good records fill from the front and bad records
+	// fill from the back, and we reverse the bad records at the end.
+	all := make([]*Record, fs.NumRecords())
+	g, b := 0, len(all)
+	fs.EachRecord(func(r *Record) {
+		if fn(r) {
+			all[g] = r
+			g++
+		} else {
+			b--
+			all[b] = r
+		}
+	})
+	good, bad = all[:g:g], all[b:]
+	for i, j := 0, len(bad)-1; i < j; i, j = i+1, j-1 {
+		bad[i], bad[j] = bad[j], bad[i]
+	}
+	return good, bad
+}
+
+// FreshnessByTopic returns, for each topic, how long ago the newest record in
+// that topic was timestamped.
+//
+// Records with no timestamp (pre 0.10.0 message sets) are skipped, and topics
+// that only have records with no timestamp are not included.
+func (fs Fetches) FreshnessByTopic() map[string]time.Duration {
+	newest := make(map[string]time.Time)
+	fs.EachPartition(func(p FetchTopicPartition) {
+		for _, r := range p.Partition.Records {
+			if r.Attrs.TimestampType() < 0 {
+				continue
+			}
+			if ts, exists := newest[p.Topic]; !exists || r.Timestamp.After(ts) {
+				newest[p.Topic] = r.Timestamp
+			}
+		}
+	})
+	freshness := make(map[string]time.Duration, len(newest))
+	for topic, ts := range newest {
+		freshness[topic] = time.Since(ts)
+	}
+	return freshness
+}
+
+// EachLatestByKey calls fn once per topic and key with the latest record for
+// that key in Fetches, which is useful for "last write wins" processing.
+//
+// Within a partition, the latest record is the record with the highest
+// offset. If the same key is in multiple partitions of a topic (which does
+// not happen if producing with a consistent key partitioner), the record that
+// comes later in RecordIter order wins. Records with nil keys cannot be
+// deduplicated and are all passed to fn.
+//
+// Tombstones (records with a nil value) are passed to fn like any other
+// record, so that deletes can be applied. Records are passed in no specific
+// order.
+func (fs Fetches) EachLatestByKey(fn func(*Record)) {
+	type topicKey struct {
+		topic string
+		key   string
+	}
+	latest := make(map[topicKey]*Record)
+	var nilKeys []*Record
+	fs.EachRecord(func(r *Record) {
+		if r.Key == nil {
+			nilKeys = append(nilKeys, r)
+			return
+		}
+		latest[topicKey{r.Topic, string(r.Key)}] = r
+	})
+	for _, r := range latest {
+		fn(r)
+	}
+	for _, r := range nilKeys {
+		fn(r)
+	}
+}
+
+// OffsetsToCommit returns, per topic and partition, one past the highest
+// record offset in Fetches. This is the offset to commit after processing
+// every record in these fetches.
+//
+// Partitions with no records are not included. Unlike ToCommit, this does
+// not include leader epochs.
+func (fs Fetches) OffsetsToCommit() map[string]map[int32]int64 {
+	return fs.nextOffsets()
+}
+
+// nextOffsets returns max(Offset)+1 per topic and partition for every
+// partition with records.
+func (fs Fetches) nextOffsets() map[string]map[int32]int64 {
+	offsets := make(map[string]map[int32]int64)
+	fs.EachPartition(func(p FetchTopicPartition) {
+		for _, r := range p.Partition.Records {
+			topicOffsets := offsets[p.Topic]
+			if topicOffsets == nil {
+				topicOffsets = make(map[int32]int64)
+				offsets[p.Topic] = topicOffsets
+			}
+			if next, exists := topicOffsets[p.Partition.Partition]; !exists || r.Offset+1 > next {
+				topicOffsets[p.Partition.Partition] = r.Offset + 1
+			}
+		}
+	})
+	return offsets
+}
+
+// ValueSizePercentiles returns the length of record values at each requested
+// percentile, where percentiles are in the range [0, 1] (e.g., 0.5, 0.95,
+// 0.99). Percentiles outside this range are clamped to it.
+//
+// This collects and sorts every value length, and then uses the nearest-rank
+// method: the size at percentile p is the smallest size that at least p of
+// all values are at or under. If there are no records, this returns an empty
+// map.
+func (fs Fetches) ValueSizePercentiles(ps ...float64) map[float64]int {
+	sizes := make([]int, 0, fs.NumRecords())
+	fs.EachRecord(func(r *Record) {
+		sizes = append(sizes, len(r.Value))
+	})
+	percentiles := make(map[float64]int, len(ps))
+	if len(sizes) == 0 {
+		return percentiles
+	}
+	sort.Ints(sizes)
+	for _, p := range ps {
+		rank := int(math.Ceil(p * float64(len(sizes))))
+		switch {
+		case rank < 1:
+			rank = 1
+		case rank > len(sizes):
+			rank = len(sizes)
+		}
+		percentiles[p] = sizes[rank-1]
+	}
+	return percentiles
+}
+
+// All returns an iterator function over all records in Fetches, in the same
+// order as RecordIter. Iteration stops early if yield returns false.
+//
+// With Go 1.23+, this can be used with range:
+//
+//	for r := range fetches.All() {
+//		...
+//	}
+func (fs Fetches) All() func(yield func(*Record) bool) {
+	return func(yield func(*Record) bool) {
+		for iter := fs.RecordIter(); !iter.Done(); {
+			if !yield(iter.Next()) {
+				return
+			}
+		}
+	}
+}
+
+// AllPartitions returns an iterator function over all partitions in Fetches,
+// in the same order as EachPartition. Iteration stops early if yield returns
+// false.
+//
+// With Go 1.23+, this can be used with range, similar to All.
+func (fs Fetches) AllPartitions() func(yield func(FetchTopicPartition) bool) {
+	return func(yield func(FetchTopicPartition) bool) {
+		for _, fetch := range fs {
+			for _, topic := range fetch.Topics {
+				for i := range topic.Partitions {
+					if !yield(FetchTopicPartition{
+						Topic:     topic.Topic,
+						Partition: topic.Partitions[i],
+					}) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// Transform calls fn with a clone of every record in Fetches, in the same
+// order as RecordIter, and returns all non-nil records fn returns. This is
+// useful for mirroring records to another cluster while changing the topic,
+// key, value, or headers.
+//
+// The record passed to fn is a deep copy, so fn can freely modify it and
+// return it. Every returned record has the fields that the client sets when
+// producing (timestamp, partition, attrs, producer ID and epoch, leader
+// epoch, and offset) reset, meaning the returned records are ready to be
+// produced.
+func (fs Fetches) Transform(fn func(*Record) *Record) []*Record {
+	var transformed []*Record
+	fs.EachRecord(func(r *Record) {
+		r = fn(r.clone())
+		if r == nil {
+			return
+		}
+		*r = Record{
+			Key:     r.Key,
+			Value:   r.Value,
+			Headers: r.Headers,
+			Topic:   r.Topic,
+		}
+		transformed = append(transformed, r)
+	})
+	return transformed
+}
+
+// Positions2 returns the position that consuming would resume from for each
+// partition in Fetches, derived purely from the fetched data.
+//
+// For partitions with records, the position is one past the last record's
+// offset, even if the partition also has an error (such as a parse error
+// partway through the response). For partitions with no records, the position
+// is the partition's LogStartOffset, unless it is unknown (negative), in
+// which case the partition is not included. Partitions with an error and no
+// records are not included: the client injects these for errors such as data
+// loss or auth failures with zero watermarks, and using their LogStartOffset
+// would rewind consuming to offset 0. If a partition is in the fetches
+// multiple times, the highest position wins.
+func (fs Fetches) Positions2() map[TopicPartition]int64 {
+	positions := make(map[TopicPartition]int64)
+	fs.EachPartition(func(p FetchTopicPartition) {
+		tp := TopicPartition{p.Topic, p.Partition.Partition}
+		var position int64
+		switch {
+		case len(p.Partition.Records) > 0:
+			position = p.Partition.Records[len(p.Partition.Records)-1].Offset + 1
+		case p.Partition.Err == nil:
+			position = p.Partition.LogStartOffset
+		default:
+			return
+		}
+		if position < 0 {
+			return
+		}
+		if existing, exists := positions[tp]; !exists || position > existing {
+			positions[tp] = position
+		}
+	})
+	return positions
+}
+
+// EncodeJSON writes every record in Fetches to w as newline delimited JSON,
+// in the same order as RecordIter. Each record is encoded and written
+// individually, so this does not buffer all records in memory.
+//
+// Each record is written as an object with the following fields:
+//
+//	topic      string
+//	partition  number
+//	offset     number
+//	timestamp  RFC 3339 string, or null if the record has no timestamp
+//	key        base64 string, or null if the key is nil
+//	value      base64 string, or null if the value is nil
+//	headers    array of {"key": string, "value": base64 string}
+//
+// This returns the first error encountered while writing.
+func (fs Fetches) EncodeJSON(w io.Writer) error {
+	type jsonHeader struct {
+		Key   string `json:"key"`
+		Value []byte `json:"value"`
+	}
+	type jsonRecord struct {
+		Topic     string       `json:"topic"`
+		Partition int32        `json:"partition"`
+		Offset    int64        `json:"offset"`
+		Timestamp *string      `json:"timestamp"`
+		Key       []byte       `json:"key"`
+		Value     []byte       `json:"value"`
+		Headers   []jsonHeader `json:"headers"`
+	}
+
+	enc := json.NewEncoder(w)
+	for iter := fs.RecordIter(); !iter.Done(); {
+		r := iter.Next()
+		jr := jsonRecord{
+			Topic:     r.Topic,
+			Partition: r.Partition,
+			Offset:    r.Offset,
+			Key:       r.Key,
+			Value:     r.Value,
+			Headers:   make([]jsonHeader, 0, len(r.Headers)),
+		}
+		if r.Attrs.TimestampType() >= 0 {
+			ts := r.Timestamp.Format(time.RFC3339Nano)
+			jr.Timestamp = &ts
+		}
+		for _, h := range r.Headers {
+			jr.Headers = append(jr.Headers, jsonHeader{h.Key, h.Value})
+		}
+		if err := enc.Encode(jr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachTransaction calls fn for every transaction in Fetches that ends in the
+// fetches, with the transaction's records (in offset order) and whether the
+// transaction was committed or aborted.
+//
+// A transaction ends with a control record, so this requires the
+// KeepControlRecords option; control records themselves are not passed to fn.
+// Within a partition, transactional records are grouped by producer ID, and
+// each producer's group ends at that producer's next control record. Control
+// records are processed in offset order per partition, and partitions are
+// visited in the same order as EachPartition.
+//
+// This function does not keep any state across fetches. Records for a
+// transaction that has not ended in these fetches are not passed to fn. If a
+// transaction began in prior fetches, fn is only called with the records that
+// are in these fetches. If a transaction has no records in these fetches
+// (only its ending control record), fn is not called. Records that are not
+// transactional are skipped.
+func (fs Fetches) EachTransaction(fn func(records []*Record, committed bool)) {
+	fs.EachPartition(func(p FetchTopicPartition) {
+		var open map[int64][]*Record
+		for _, r := range p.Partition.Records {
+			if !r.Attrs.IsTransactional() {
+				continue
+			}
+			if !r.Attrs.IsControl() {
+				if open == nil {
+					open = make(map[int64][]*Record)
+				}
+				open[r.ProducerID] = append(open[r.ProducerID], r)
+				continue
+			}
+
+			// A control record has a key and a value where the key
+			// is int16 version and int16 type. Aborts have a type of
+			// 0 and commits have a type of 1.
+			txn := open[r.ProducerID]
+			delete(open, r.ProducerID)
+			if len(txn) == 0 || len(r.Key) < 4 {
+				continue
+			}
+			fn(txn, r.Key[2] == 0 && r.Key[3] == 1)
+		}
+	})
+}
+
+// EachByProducer calls fn for each record in Fetches, in the same order as
+// RecordIter, with the producer ID and epoch the record was produced with.
+//
+// The ID and epoch are passed as they are on the record. Records that were
+// not produced with a producer ID are never skipped; these have an ID and
+// epoch of -1, which is what non-idempotent producers write in record
+// batches and what the client sets for records from old message sets (some
+// producers may instead write 0 and 0).
+func (fs Fetches) EachByProducer(fn func(producerID int64, producerEpoch int16, r *Record)) {
+	fs.EachRecord(func(r *Record) {
+		fn(r.ProducerID, r.ProducerEpoch, r)
+	})
+}
+
+// ConcatFetches returns a new Fetches containing every Fetch from each input,
+// in argument order. No grouping of topics or partitions is done, so
+// RecordIter over the result visits all records of the first Fetches, then
+// all records of the second, and so on.
+//
+// The returned Fetches shares topics, partitions, and records with the input.
+func ConcatFetches(fss ...Fetches) Fetches {
+	var n int
+	for _, fs := range fss {
+		n += len(fs)
+	}
+	concat := make(Fetches, 0, n)
+	for _, fs := range fss {
+		concat = append(concat, fs...)
+	}
+	return concat
+}
+
+// EachRecordUntilBytes calls fn for records in Fetches, in the same order as
+// RecordIter, until processing the next record would bring the sum of
+// processed record sizes over maxBytes. This returns the sum of the sizes of
+// processed records and whether any records remain unvisited.
+//
+// Record sizes are from Record.ApproxSize. The first record is always
+// processed, even if its size alone exceeds maxBytes, so that a single large
+// record can never prevent progress.
+func (fs Fetches) EachRecordUntilBytes(maxBytes int64, fn func(*Record)) (consumedBytes int64, more bool) {
+	iter := fs.RecordIter()
+	for first := true; !iter.Done(); first = false {
+		size := iter.peek().ApproxSize()
+		if !first && consumedBytes+size > maxBytes {
+			break
+		}
+		fn(iter.Next())
+		consumedBytes += size
+	}
+	return consumedBytes, !iter.Done()
+}
+
+// TotalRecords returns the total number of records across all input Fetches.
+// This is useful for aggregating fetches polled from many goroutines.
+func TotalRecords(fss ...Fetches) int {
+	var n int
+	for _, fs := range fss {
+		n += fs.NumRecords()
+	}
+	return n
+}
+
+// TotalBytes returns the sum of Record.ApproxSize for all records across all
+// input Fetches.
+func TotalBytes(fss ...Fetches) int64 {
+	var n int64
+	for _, fs := range fss {
+		for _, f := range fs {
+			for _, t := range f.Topics {
+				for _, p := range t.Partitions {
+					for _, r := range p.Records {
+						n += r.ApproxSize()
+					}
+				}
+			}
+		}
+	}
+	return n
+}
+
+// EachRecordGroupedByKey calls fn once per distinct record key in Fetches with
+// all records that have that key, across all topics and partitions.
+//
+// Records for a key are in RecordIter order, that is, in offset order within
+// a partition and in fetch order across partitions. Keys are passed to fn in
+// the order they are first seen in RecordIter order. All records with a nil
+// key are grouped together and passed with a nil key; this group is distinct
+// from records with an empty, non-nil key.
+//
+// To group records, this must buffer every record in Fetches into per key
+// slices before calling fn, meaning this allocates memory proportional to
+// the number of records.
+func (fs Fetches) EachRecordGroupedByKey(fn func(key []byte, records []*Record)) {
+	var (
+		idxs   = make(map[string]int)
+		groups [][]*Record
+		nilIdx = -1
+	)
+	fs.EachRecord(func(r *Record) {
+		var idx int
+		var exists bool
+		if r.Key == nil {
+			idx, exists = nilIdx, nilIdx >= 0
+		} else {
+			idx, exists = idxs[string(r.Key)]
+		}
+		if !exists {
+			idx = len(groups)
+			groups = append(groups, nil)
+			if r.Key == nil {
+				nilIdx = idx
+			} else {
+				idxs[string(r.Key)] = idx
+			}
+		}
+		groups[idx] = append(groups[idx], r)
+	})
+	for _, group := range groups {
+		fn(group[0].Key, group)
+	}
+}
+
+// FilterRecords returns the records in Fetches whose attributes match pred,
+// in the same order as RecordIter. For example, to return only transactional
+// records compressed with zstd:
+//
+//	fetches.FilterRecords(func(a RecordAttrs) bool {
+//		return a.IsTransactional() && a.Is(ZstdCompression())
+//	})
+//
+// The returned slice is not pre-sized; it grows as matching records are
+// found, so filters that match few records allocate little.
+func (fs Fetches) FilterRecords(pred func(RecordAttrs) bool) []*Record {
+	var matched []*Record
+	fs.EachRecord(func(r *Record) {
+		if pred(r.Attrs) {
+			matched = append(matched, r)
+		}
+	})
+	return matched
+}
+
+// Status returns whether Fetches has any records, whether it has any
+// partition errors, and whether it is empty (no records and no errors), in
+// one pass over all partitions.
+//
+// An empty poll generally means the consumer is idle, whereas a poll with
+// errors and no records may mean the consumer is unhealthy.
+func (fs Fetches) Status() (hasRecords, hasErrors, empty bool) {
+	for _, f := range fs {
+		for _, t := range f.Topics {
+			for _, p := range t.Partitions {
+				hasRecords = hasRecords || len(p.Records) > 0
+				hasErrors = hasErrors || p.Err != nil
+				if hasRecords && hasErrors {
+					return true, true, false
+				}
+			}
+		}
+	}
+	return hasRecords, hasErrors, !hasRecords && !hasErrors
+}
+
+// TimestampRange returns the oldest and newest record timestamps in Fetches,
+// or false if there are no records with timestamps.
+//
+// Records with no timestamp (pre 0.10.0 message sets) are skipped. Because
+// CreateTime timestamps are set by producers and are not necessarily in
+// order, this checks every record rather than only the first and last record
+// in each partition.
+func (fs Fetches) TimestampRange() (min, max time.Time, ok bool) {
+	min, max, n := fs.timestampRange()
+	return min, max, n > 0
+}
+
+// timestampRange returns the oldest and newest record timestamps and the
+// number of records with timestamps.
+func (fs Fetches) timestampRange() (min, max time.Time, n int) {
+	fs.EachRecord(func(r *Record) {
+		if r.Attrs.TimestampType() < 0 {
+			return
+		}
+		if n == 0 || r.Timestamp.Before(min) {
+			min = r.Timestamp
+		}
+		if n == 0 || r.Timestamp.After(max) {
+			max = r.Timestamp
+		}
+		n++
+	})
+	return min, max, n
+}
+
+// RecordsByPartition returns all records in Fetches grouped by topic and
+// partition. If a partition is in multiple fetches, its records are merged in
+// fetch order. Partitions with no records are not included, and if there are
+// no records, this returns an empty, non-nil map.
+//
+// Partitions that are only in one fetch share the fetched records slice.
+func (fs Fetches) RecordsByPartition() map[string]map[int32][]*Record {
+	byPartition := make(map[string]map[int32][]*Record)
+	fs.EachPartition(func(p FetchTopicPartition) {
+		records := p.Partition.Records
+		if len(records) == 0 {
+			return
+		}
+		topicPartitions := byPartition[p.Topic]
+		if topicPartitions == nil {
+			topicPartitions = make(map[int32][]*Record)
+			byPartition[p.Topic] = topicPartitions
+		}
+		existing, exists := topicPartitions[p.Partition.Partition]
+		if !exists {
+			// We cap the slice so that merging with the same
+			// partition from a later fetch never appends into the
+			// fetched records backing array.
+			topicPartitions[p.Partition.Partition] = records[:len(records):len(records)]
+			return
+		}
+		topicPartitions[p.Partition.Partition] = append(existing, records...)
+	})
+	return byPartition
+}
+
+// DeepCopy returns a copy of Fetches that shares no memory with the original,
+// other than partition errors. Every fetch, topic, and partition is rebuilt
+// with the same fields, and every record is copied along with its key, value,
+// and headers.
+//
+// This is expensive: it allocates for every record and every byte of record
+// data. This is only useful if records need to be retained and cannot alias
+// the original fetched data.
+func (fs Fetches) DeepCopy() Fetches {
+	if fs == nil {
+		return nil
+	}
+	cp := make(Fetches, len(fs))
+	for i, f := range fs {
+		if f.Topics == nil {
+			continue
+		}
+		cp[i].Topics = make([]FetchTopic, len(f.Topics))
+		for j, t := range f.Topics {
+			cpt := &cp[i].Topics[j]
+			cpt.Topic = t.Topic
+			if t.Partitions == nil {
+				continue
+			}
+			cpt.Partitions = make([]FetchPartition, len(t.Partitions))
+			for k, p := range t.Partitions {
+				cpp := &cpt.Partitions[k]
+				*cpp = p
+				if p.Records == nil {
+					continue
+				}
+				cpp.Records = make([]*Record, len(p.Records))
+				for l, r := range p.Records {
+					cpp.Records[l] = r.clone()
+				}
+			}
+		}
+	}
+	return cp
+}
+
+// NextOffsets returns, per topic and partition, the offset to resume fetching
+// from after processing every record in Fetches: one past the highest record
+// offset. This is useful for managing offsets outside of a group.
+//
+// Partitions with no records are not included, even if their log start
+// offset or high watermark is known, because no position can be derived from
+// records that were not returned. The values are the same as
+// OffsetsToCommit; the two functions differ only in intent.
+func (fs Fetches) NextOffsets() map[string]map[int32]int64 {
+	return fs.nextOffsets()
+}
+
+// EachErrorPartition calls fn for each partition in Fetches that has a
+// non-nil Err, in the same order as EachPartition.
+//
+// Unlike EachErr, this passes the full partition, meaning fn has access to
+// the partition's watermarks and any records that were fetched before the
+// error.
+func (fs Fetches) EachErrorPartition(fn func(FetchTopicPartition)) {
+	fs.EachPartition(func(p FetchTopicPartition) {
+		if p.Partition.Err != nil {
+			fn(p)
+		}
+	})
+}
+
+// EachRecordIndexed calls fn for each record in Fetches, in the same order as
+// RecordIter, along with the record's index in that order (starting at 0).
+func (fs Fetches) EachRecordIndexed(fn func(index int, r *Record)) {
+	var index int
+	fs.EachRecord(func(r *Record) {
+		fn(index, r)
+		index++
+	})
+}
+
+// SplitPartitions splits Fetches into two: partitions that pred returns true
+// for, and all other partitions. The fetch, topic, and partition order of
+// the input is preserved in both outputs, and topics or fetches that end up
+// with no partitions are dropped.
+//
+// Both returned Fetches alias the original records slices; only the fetch
+// and topic structure is rebuilt.
+func (fs Fetches) SplitPartitions(pred func(topic string, partition int32) bool) (matched, rest Fetches) {
+	for _, f := range fs {
+		var fmatched, frest Fetch
+		for _, t := range f.Topics {
+			tmatched, trest := FetchTopic{Topic: t.Topic}, FetchTopic{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				if pred(t.Topic, p.Partition) {
+					tmatched.Partitions = append(tmatched.Partitions, p)
+				} else {
+					trest.Partitions = append(trest.Partitions, p)
+				}
+			}
+			if len(tmatched.Partitions) > 0 {
+				fmatched.Topics = append(fmatched.Topics, tmatched)
+			}
+			if len(trest.Partitions) > 0 {
+				frest.Topics = append(frest.Topics, trest)
+			}
+		}
+		if len(fmatched.Topics) > 0 {
+			matched = append(matched, fmatched)
+		}
+		if len(frest.Topics) > 0 {
+			rest = append(rest, frest)
+		}
+	}
+	return matched, rest
+}
+
+// EachRecordInTopic calls fn for each record in the given topic across all
+// fetches and partitions, in the same order as RecordIter. Topics that do not
+// match are skipped entirely rather than record by record.
+func (fs Fetches) EachRecordInTopic(topic string, fn func(*Record)) {
+	for _, f := range fs {
+		for _, t := range f.Topics {
+			if t.Topic != topic {
+				continue
+			}
+			for _, p := range t.Partitions {
+				for _, r := range p.Records {
+					fn(r)
+				}
+			}
+		}
+	}
+}
+
+// NewFetchPartition returns a partition containing the given records, which
+// is useful for building Fetches in tests.
+//
+// The partition's log start offset is set to the first record's offset, and
+// the high watermark and last stable offset are set to one past the last
+// record's offset. These can be changed with WithWatermarks. The records
+// themselves are not modified; their Topic and Partition fields should be
+// set by the caller if needed.
+func NewFetchPartition(partition int32, records ...*Record) FetchPartition {
+	p := FetchPartition{
+		Partition: partition,
+		Records:   records,
+	}
+	if len(records) > 0 {
+		p.LogStartOffset = records[0].Offset
+		p.HighWatermark = records[len(records)-1].Offset + 1
+		p.LastStableOffset = p.HighWatermark
+	}
+	return p
+}
+
+// WithWatermarks returns a copy of the partition with the given log start
+// offset, last stable offset, and high watermark.
+func (p FetchPartition) WithWatermarks(logStart, lastStable, high int64) FetchPartition {
+	p.LogStartOffset = logStart
+	p.LastStableOffset = lastStable
+	p.HighWatermark = high
+	return p
+}
+
+// WithErr returns a copy of the partition with the given error.
+func (p FetchPartition) WithErr(err error) FetchPartition {
+	p.Err = err
+	return p
+}
+
+// NewFetchTopic returns a topic containing the given partitions, which is
+// useful for building Fetches in tests.
+func NewFetchTopic(topic string, partitions ...FetchPartition) FetchTopic {
+	return FetchTopic{
+		Topic:      topic,
+		Partitions: partitions,
+	}
+}
+
+// NewFetches returns Fetches containing one Fetch with the given topics,
+// which is useful for testing code that processes polled fetches:
+//
+//	fetches := kgo.NewFetches(
+//		kgo.NewFetchTopic("foo",
+//			kgo.NewFetchPartition(0, records...),
+//			kgo.NewFetchPartition(1).WithErr(err),
+//		),
+//	)
+func NewFetches(topics ...FetchTopic) Fetches {
+	return Fetches{{Topics: topics}}
+}
+
+// RecordPosition is the topic, partition, and offset of a record.
+type RecordPosition struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// DuplicateKeys returns, for every record key that is in Fetches more than
+// once, the position of every record with that key, in the same order as
+// RecordIter. Because offsets are only meaningful within a partition, each
+// position includes the record's topic and partition.
+//
+// Records with nil keys are excluded. Keys that are only in Fetches once are
+// not included in the returned map.
+func (fs Fetches) DuplicateKeys() map[string][]RecordPosition {
+	positions := make(map[string][]RecordPosition)
+	fs.EachRecord(func(r *Record) {
+		if r.Key == nil {
+			return
+		}
+		positions[string(r.Key)] = append(positions[string(r.Key)], RecordPosition{r.Topic, r.Partition, r.Offset})
+	})
+	for key, keyPositions := range positions {
+		if len(keyPositions) < 2 {
+			delete(positions, key)
+		}
+	}
+	return positions
+}
+
+// EachPartitionCount calls fn once per partition in Fetches with the number
+// of records fetched for that partition, in the same order as EachPartition.
+// This does not allocate.
+//
+// If a partition is spread across multiple fetches, fn is called once per
+// fetch for that partition, and it is up to the caller to sum the counts.
+func (fs Fetches) EachPartitionCount(fn func(topic string, partition int32, count int)) {
+	for _, f := range fs {
+		for _, t := range f.Topics {
+			for i := range t.Partitions {
+				p := &t.Partitions[i]
+				fn(t.Topic, p.Partition, len(p.Records))
+			}
+		}
+	}
+}
+
+// HasTransactional returns whether any record in Fetches is transactional,
+// returning as soon as one is found.
+func (fs Fetches) HasTransactional() bool {
+	for _, f := range fs {
+		for _, t := range f.Topics {
+			for _, p := range t.Partitions {
+				for _, r := range p.Records {
+					if r.Attrs.IsTransactional() {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// MapRecords calls fn for each record in Fetches, in the same order as
+// RecordIter, and returns every non-nil record fn returns. Returning nil from
+// fn drops the record, meaning fn can also filter.
+//
+// Unlike Transform, fn is passed the original fetched records, and returned
+// records are not modified. The returned slice is pre-sized to the number of
+// records in Fetches.
+func (fs Fetches) MapRecords(fn func(*Record) *Record) []*Record {
+	mapped := make([]*Record, 0, fs.NumRecords())
+	fs.EachRecord(func(r *Record) {
+		if r = fn(r); r != nil {
+			mapped = append(mapped, r)
+		}
+	})
+	return mapped
+}
+
+// MaxAge returns the largest Record.Age across all records in Fetches, which
+// is the age of the oldest record. Records with no timestamp are skipped. If
+// no records have timestamps, this returns -1.
+func (fs Fetches) MaxAge(now time.Time) time.Duration {
+	max := time.Duration(-1)
+	var ok bool
+	fs.EachRecord(func(r *Record) {
+		if r.Attrs.TimestampType() < 0 {
+			return
+		}
+		if age := r.Age(now); !ok || age > max {
+			max, ok = age, true
+		}
+	})
+	return max
+}
+
+// EstimateRate returns a rough estimate of records per second in Fetches:
+// the number of timestamped records divided by the span between the oldest
+// and newest record timestamp (the same span as TimestampRange). This returns
+// false if there are fewer than two records with timestamps or if all
+// timestamps are equal.
+//
+// This is only a dashboard convenience. The estimate is sensitive to how
+// many records a poll happens to return, and for CreateTime topics, to
+// producer clock skew and producers that write old timestamps. It should not
+// be used for anything that requires accuracy, such as billing.
+func (fs Fetches) EstimateRate() (ratePerSec float64, ok bool) {
+	min, max, n := fs.timestampRange()
+	span := max.Sub(min)
+	if n < 2 || span <= 0 {
+		return 0, false
+	}
+	return float64(n) / span.Seconds(), true
+}
+
+// CaughtUpPartitions returns the partitions in Fetches that appear to be
+// caught up to the end of the partition: partitions whose highest record
+// offset is at or past HighWatermark-1, or partitions that returned no
+// records and are empty (HighWatermark == LogStartOffset).
+//
+// A partition with no records that is not empty is not considered caught up,
+// since it is unknown whether the partition had no new data or whether
+// nothing was returned for another reason. For transactional topics, this may
+// not report partitions that are actually caught up: consumers reading
+// committed records can only consume up to the LastStableOffset, which can be
+// below the HighWatermark, and the final offset before the HighWatermark is
+// often a control record, which is not returned by default.
+//
+// Partitions with an error are never considered caught up. Errors the client
+// injects (such as for data loss or auth failures) have no records and zero
+// watermarks, and a partition that errored partway through parsing a
+// response stopped before the remaining records in that response.
+func (fs Fetches) CaughtUpPartitions() []FetchTopicPartition {
+	var caughtUp []FetchTopicPartition
+	fs.EachPartition(func(p FetchTopicPartition) {
+		if p.Partition.Err != nil {
+			return
+		}
+		records := p.Partition.Records
+		if len(records) == 0 && p.Partition.HighWatermark == p.Partition.LogStartOffset ||
+			len(records) > 0 && records[len(records)-1].Offset >= p.Partition.HighWatermark-1 {
+			caughtUp = append(caughtUp, p)
+		}
+	})
+	return caughtUp
+}
+
+// Records returns all records in Fetches, in the same order as RecordIter.
+func (fs Fetches) Records() []*Record {
+	return fs.RecordIter().Collect()
+}
@@ -0,0 +1,962 @@
+package kgo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFetches returns a Fetches spread across two fetches, where topic "b" is
+// in both fetches. Every record has its topic, partition, and offset set.
+func testFetches() Fetches {
+	recs := func(topic string, partition int32, offsets ...int64) []*Record {
+		var rs []*Record
+		for _, o := range offsets {
+			rs = append(rs, &Record{Topic: topic, Partition: partition, Offset: o})
+		}
+		return rs
+	}
+	return Fetches{
+		{Topics: []FetchTopic{
+			{Topic: "a", Partitions: []FetchPartition{
+				{Partition: 0, HighWatermark: 3, Records: recs("a", 0, 0, 1, 2)},
+				{Partition: 1, HighWatermark: 10},
+				{Partition: 2, HighWatermark: 7, Records: recs("a", 2, 5, 6)},
+			}},
+			{Topic: "b", Partitions: []FetchPartition{
+				{Partition: 0, HighWatermark: 1, Records: recs("b", 0, 0)},
+			}},
+		}},
+		{Topics: []FetchTopic{
+			{Topic: "b", Partitions: []FetchPartition{
+				{Partition: 1, HighWatermark: 9, Records: recs("b", 1, 3, 4)},
+			}},
+		}},
+	}
+}
+
+func TestRecordIterWithPartition(t *testing.T) {
+	fs := testFetches()
+
+	var exp []*Record
+	fs.EachRecord(func(r *Record) { exp = append(exp, r) })
+
+	var i int
+	for iter := fs.RecordIterWithPartition(); !iter.Done(); i++ {
+		r, p := iter.Next()
+		if i >= len(exp) {
+			t.Fatalf("iterated past %d expected records", len(exp))
+		}
+		if r != exp[i] {
+			t.Errorf("#%d: got record %s/%d@%d, exp %s/%d@%d", i, r.Topic, r.Partition, r.Offset, exp[i].Topic, exp[i].Partition, exp[i].Offset)
+		}
+		if p.Partition != r.Partition || p.HighWatermark <= r.Offset {
+			t.Errorf("#%d: record %s/%d@%d returned with mismatched partition %d (hwm %d)", i, r.Topic, r.Partition, r.Offset, p.Partition, p.HighWatermark)
+		}
+	}
+	if i != len(exp) {
+		t.Errorf("got %d records, exp %d", i, len(exp))
+	}
+}
+
+func TestTopNByTime(t *testing.T) {
+	base := time.Unix(1000, 0)
+	var rs []*Record
+	for _, sec := range []int64{5, 1, 9, 3, 7, 8, 2} {
+		rs = append(rs, &Record{Timestamp: base.Add(time.Duration(sec) * time.Second), Offset: sec})
+	}
+	rs = append(rs, &Record{Timestamp: base.Add(time.Hour), Attrs: RecordAttrs{0b1000_0000}, Offset: 100})
+	fs := Fetches{{Topics: []FetchTopic{{Topic: "t", Partitions: []FetchPartition{{Records: rs}}}}}}
+
+	for _, test := range []struct {
+		n   int
+		exp []int64
+	}{
+		{-1, nil},
+		{0, nil},
+		{1, []int64{9}},
+		{3, []int64{9, 8, 7}},
+		{100, []int64{9, 8, 7, 5, 3, 2, 1}},
+	} {
+		var got []int64
+		for _, r := range fs.TopNByTime(test.n) {
+			got = append(got, r.Offset)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("n %d: got %v != exp %v", test.n, got, test.exp)
+		}
+	}
+}
+
+func TestFetchesPartition(t *testing.T) {
+	fs := testFetches()
+	good, bad := fs.Partition(func(r *Record) bool { return r.Offset%2 == 0 })
+
+	var expGood, expBad []*Record
+	fs.EachRecord(func(r *Record) {
+		if r.Offset%2 == 0 {
+			expGood = append(expGood, r)
+		} else {
+			expBad = append(expBad, r)
+		}
+	})
+	if !reflect.DeepEqual(good, expGood) {
+		t.Errorf("good records mismatch")
+	}
+	if !reflect.DeepEqual(bad, expBad) {
+		t.Errorf("bad records mismatch")
+	}
+	if n := fs.NumRecords(); len(good)+len(bad) != n {
+		t.Errorf("got %d good + %d bad records, exp %d total", len(good), len(bad), n)
+	}
+}
+
+func TestToCommit(t *testing.T) {
+	fs := testFetches()
+	fs.EachRecord(func(r *Record) { r.LeaderEpoch = int32(r.Offset) % 3 })
+	fs = append(fs, Fetch{Topics: []FetchTopic{{Topic: "a", Partitions: []FetchPartition{
+		{Partition: 0, Records: []*Record{{Topic: "a", Offset: 1, LeaderEpoch: 9}}}, // older than the first fetch
+		{Partition: 2, Records: []*Record{{Topic: "a", Partition: 2, Offset: 8, LeaderEpoch: 4}}},
+	}}}})
+
+	exp := map[string]map[int32]EpochOffset{
+		"a": {0: {2, 3}, 2: {4, 9}},
+		"b": {0: {0, 1}, 1: {1, 5}},
+	}
+	if got := fs.ToCommit(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}
+
+func TestOffsetsToCommit(t *testing.T) {
+	fs := testFetches()
+	exp := map[string]map[int32]int64{
+		"a": {0: 3, 2: 7},
+		"b": {0: 1, 1: 5},
+	}
+	if got := fs.OffsetsToCommit(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}
+
+func TestValueSizePercentiles(t *testing.T) {
+	var rs []*Record
+	for i := 100; i > 0; i-- {
+		rs = append(rs, &Record{Value: make([]byte, i)})
+	}
+	fs := Fetches{{Topics: []FetchTopic{{Topic: "t", Partitions: []FetchPartition{{Records: rs}}}}}}
+
+	got := fs.ValueSizePercentiles(-1, 0, 0.5, 0.95, 0.99, 1, 2)
+	exp := map[float64]int{-1: 1, 0: 1, 0.5: 50, 0.95: 95, 0.99: 99, 1: 100, 2: 100}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+
+	if got := (Fetches{}).ValueSizePercentiles(0.5); len(got) != 0 {
+		t.Errorf("got %v for no records, exp empty", got)
+	}
+}
+
+func TestFetchesAll(t *testing.T) {
+	fs := testFetches()
+
+	var exp []*Record
+	fs.EachRecord(func(r *Record) { exp = append(exp, r) })
+
+	var got []*Record
+	fs.All()(func(r *Record) bool {
+		got = append(got, r)
+		return true
+	})
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("all records mismatch")
+	}
+
+	got = got[:0]
+	fs.All()(func(r *Record) bool {
+		got = append(got, r)
+		return len(got) < 3
+	})
+	if !reflect.DeepEqual(got, exp[:3]) {
+		t.Errorf("early stopped records mismatch")
+	}
+
+	var partitions int
+	fs.AllPartitions()(func(FetchTopicPartition) bool {
+		partitions++
+		return partitions < 2
+	})
+	if partitions != 2 {
+		t.Errorf("got %d partitions before stopping, exp 2", partitions)
+	}
+}
+
+func TestFetchesTransform(t *testing.T) {
+	orig := &Record{
+		Key:         []byte("k"),
+		Value:       []byte("v"),
+		Headers:     []RecordHeader{{"h", []byte("hv")}},
+		Timestamp:   time.Unix(1, 0),
+		Topic:       "t",
+		Partition:   3,
+		LeaderEpoch: 2,
+		Offset:      10,
+	}
+	fs := Fetches{{Topics: []FetchTopic{{Topic: "t", Partitions: []FetchPartition{{Partition: 3, Records: []*Record{orig, {Topic: "t", Offset: 11}}}}}}}}
+
+	got := fs.Transform(func(r *Record) *Record {
+		if r.Offset == 11 {
+			return nil
+		}
+		r.Topic = "mirror"
+		r.Value[0] = 'x'
+		return r
+	})
+	exp := []*Record{{
+		Key:     []byte("k"),
+		Value:   []byte("x"),
+		Headers: []RecordHeader{{"h", []byte("hv")}},
+		Topic:   "mirror",
+	}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %#v != exp %#v", got[0], exp[0])
+	}
+	if string(orig.Value) != "v" || orig.Topic != "t" || orig.Offset != 10 {
+		t.Errorf("original record was modified: %#v", orig)
+	}
+}
+
+func TestRecordAtOffset(t *testing.T) {
+	var p FetchPartition
+	if _, ok := p.RecordAtOffset(0); ok {
+		t.Error("found record in empty partition")
+	}
+
+	for _, offsets := range [][]int64{
+		{3, 4, 5, 6, 7},     // contiguous
+		{3, 5, 6, 9, 10},    // compacted gaps
+		{3, 4, 8, 100, 101}, // large gap
+	} {
+		p.Records = p.Records[:0]
+		for _, o := range offsets {
+			p.Records = append(p.Records, &Record{Offset: o})
+		}
+		present := make(map[int64]bool)
+		for _, o := range offsets {
+			present[o] = true
+		}
+		for o := int64(0); o < 105; o++ {
+			r, ok := p.RecordAtOffset(o)
+			if ok != present[o] {
+				t.Errorf("%v: offset %d: got found? %v, exp %v", offsets, o, ok, present[o])
+			} else if ok && r.Offset != o {
+				t.Errorf("%v: offset %d: got record at offset %d", offsets, o, r.Offset)
+			}
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	fs := Fetches{{Topics: []FetchTopic{{Topic: "t", Partitions: []FetchPartition{{Partition: 1, Records: []*Record{
+		{
+			Topic:     "t",
+			Partition: 1,
+			Offset:    4,
+			Timestamp: time.Unix(1, 500).UTC(),
+			Key:       []byte("k"),
+			Value:     []byte("v"),
+			Headers:   []RecordHeader{{"h", []byte("hv")}},
+		},
+		{
+			Topic:     "t",
+			Partition: 1,
+			Offset:    5,
+			Attrs:     RecordAttrs{0b1000_0000},
+		},
+	}}}}}}}
+
+	var buf bytes.Buffer
+	if err := fs.EncodeJSON(&buf); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	exp := `{"topic":"t","partition":1,"offset":4,"timestamp":"1970-01-01T00:00:01.0000005Z","key":"aw==","value":"dg==","headers":[{"key":"h","value":"aHY="}]}
+{"topic":"t","partition":1,"offset":5,"timestamp":null,"key":null,"value":null,"headers":[]}
+`
+	if got := buf.String(); got != exp {
+		t.Errorf("got:\n%s\nexp:\n%s", got, exp)
+	}
+}
+
+func TestEachTransaction(t *testing.T) {
+	const txnal, control = 0b0001_0000, 0b0011_0000
+	var (
+		commit = []byte{0, 0, 0, 1}
+		abort  = []byte{0, 0, 0, 0}
+	)
+	rs := []*Record{
+		{Offset: 0, ProducerID: 1, Attrs: RecordAttrs{txnal}}, // began in a prior poll
+		{Offset: 1, ProducerID: 2, Attrs: RecordAttrs{txnal}},
+		{Offset: 2}, // not transactional
+		{Offset: 3, ProducerID: 1, Attrs: RecordAttrs{txnal}},
+		{Offset: 4, ProducerID: 1, Attrs: RecordAttrs{control}, Key: commit},
+		{Offset: 5, ProducerID: 2, Attrs: RecordAttrs{txnal}},
+		{Offset: 6, ProducerID: 2, Attrs: RecordAttrs{control}, Key: abort},
+		{Offset: 7, ProducerID: 3, Attrs: RecordAttrs{control}, Key: commit}, // no records in this poll
+		{Offset: 8, ProducerID: 1, Attrs: RecordAttrs{txnal}},                // not yet ended
+	}
+	fs := Fetches{{Topics: []FetchTopic{{Topic: "t", Partitions: []FetchPartition{{Records: rs}}}}}}
+
+	type txn struct {
+		offsets   []int64
+		committed bool
+	}
+	var got []txn
+	fs.EachTransaction(func(records []*Record, committed bool) {
+		var offsets []int64
+		for _, r := range records {
+			offsets = append(offsets, r.Offset)
+		}
+		got = append(got, txn{offsets, committed})
+	})
+	exp := []txn{
+		{[]int64{0, 3}, true},
+		{[]int64{1, 5}, false},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}
+
+func TestEachRecordUntilBytes(t *testing.T) {
+	var rs []*Record
+	for _, size := range []int{10, 20, 30, 100} {
+		rs = append(rs, &Record{Value: make([]byte, size)})
+	}
+	fs := Fetches{{Topics: []FetchTopic{{Topic: "t", Partitions: []FetchPartition{{Records: rs}}}}}}
+
+	for _, test := range []struct {
+		max       int64
+		processed int
+		consumed  int64
+		more      bool
+	}{
+		{0, 1, 10, true}, // the first record is always processed
+		{29, 1, 10, true},
+		{30, 2, 30, true},
+		{60, 3, 60, true},
+		{159, 3, 60, true},
+		{160, 4, 160, false},
+		{1000, 4, 160, false},
+	} {
+		var processed int
+		consumed, more := fs.EachRecordUntilBytes(test.max, func(*Record) { processed++ })
+		if processed != test.processed || consumed != test.consumed || more != test.more {
+			t.Errorf("max %d: got (%d, %d, %v) != exp (%d, %d, %v)",
+				test.max, processed, consumed, more, test.processed, test.consumed, test.more)
+		}
+	}
+
+	if consumed, more := (Fetches{}).EachRecordUntilBytes(10, func(*Record) {}); consumed != 0 || more {
+		t.Errorf("got (%d, %v) for no records, exp (0, false)", consumed, more)
+	}
+}
+
+func TestRecordFieldsRoundTrip(t *testing.T) {
+	r := &Record{
+		Key:   []byte("k"),
+		Value: []byte("v"),
+		Headers: []RecordHeader{
+			{"a", []byte("1")},
+			{"b", []byte("2")},
+			{"a", []byte("3")},
+		},
+		Timestamp: time.Unix(10, 0),
+		Topic:     "t",
+		Partition: 2,
+		Offset:    7,
+	}
+	got := r.Fields().ToRecord()
+	exp := *r
+	exp.Headers = []RecordHeader{
+		{"a", []byte("1")},
+		{"a", []byte("3")},
+		{"b", []byte("2")},
+	}
+	if !reflect.DeepEqual(*got, exp) {
+		t.Errorf("got %#v != exp %#v", *got, exp)
+	}
+}
+
+func TestTotalRecordsBytes(t *testing.T) {
+	fs := testFetches()
+	fs[0].Topics[0].Partitions[0].Records[0].Value = []byte("foo")
+	fs[1].Topics[0].Partitions[0].Records[0].Key = []byte("ba")
+
+	if got, exp := TotalRecords(fs, fs, nil), 2*fs.NumRecords(); got != exp {
+		t.Errorf("got %d records != exp %d", got, exp)
+	}
+	if got, exp := TotalBytes(fs, fs, nil), int64(2*5); got != exp {
+		t.Errorf("got %d bytes != exp %d", got, exp)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		TotalRecords(fs, fs)
+		TotalBytes(fs, fs)
+	}); allocs != 0 {
+		t.Errorf("got %v allocs, exp 0", allocs)
+	}
+}
+
+func TestEachRecordGroupedByKey(t *testing.T) {
+	fs := testFetches()
+	keys := [][]byte{[]byte("x"), nil, []byte("y"), {}, []byte("x"), nil, []byte("y"), []byte("x")}
+	var i int
+	fs.EachRecord(func(r *Record) {
+		r.Key = keys[i]
+		i++
+	})
+
+	type group struct {
+		key     []byte
+		offsets []int64
+	}
+	var got []group
+	fs.EachRecordGroupedByKey(func(key []byte, records []*Record) {
+		g := group{key: key}
+		for _, r := range records {
+			g.offsets = append(g.offsets, r.Offset)
+		}
+		got = append(got, g)
+	})
+	exp := []group{
+		{[]byte("x"), []int64{0, 6, 4}},
+		{nil, []int64{1, 0}},
+		{[]byte("y"), []int64{2, 3}},
+		{[]byte{}, []int64{5}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}
+
+func TestTrimToOffset(t *testing.T) {
+	p := FetchPartition{Partition: 1, HighWatermark: 20, LastStableOffset: 20}
+	for _, o := range []int64{3, 5, 6, 9, 10} {
+		p.Records = append(p.Records, &Record{Offset: o})
+	}
+	for _, test := range []struct {
+		offset int64
+		first  int // index into p.Records
+	}{
+		{0, 0},
+		{3, 0},
+		{4, 1},
+		{6, 2},
+		{7, 3},
+		{10, 4},
+		{11, 5},
+	} {
+		trimmed := p.TrimToOffset(test.offset)
+		if !reflect.DeepEqual(trimmed.Records, p.Records[test.first:]) {
+			t.Errorf("offset %d: got records starting at wrong index, exp %d", test.offset, test.first)
+		}
+		trimmed.Records = p.Records
+		if !reflect.DeepEqual(trimmed, p) {
+			t.Errorf("offset %d: non-record fields were modified", test.offset)
+		}
+	}
+}
+
+func TestStringRecord(t *testing.T) {
+	r := KeyStringRecord("key", "value")
+	if string(r.Key) != "key" || string(r.Value) != "value" {
+		t.Errorf("got key %q value %q, exp key %q value %q", r.Key, r.Value, "key", "value")
+	}
+	r.SetKeyString("")
+	r.SetValueString("foo")
+	if len(r.Key) != 0 || string(r.Value) != "foo" {
+		t.Errorf("got key %q value %q after set, exp key %q value %q", r.Key, r.Value, "", "foo")
+	}
+}
+
+func TestRecordsByPartition(t *testing.T) {
+	fs := testFetches()
+	fs = append(fs, Fetch{Topics: []FetchTopic{{Topic: "a", Partitions: []FetchPartition{{Partition: 2, Records: []*Record{{Offset: 7}}}}}}})
+	a2 := fs[0].Topics[0].Partitions[2].Records
+	a2 = append(a2[:len(a2):len(a2)], nil)[:len(a2)] // spare capacity that merging must not write into
+	fs[0].Topics[0].Partitions[2].Records = a2
+
+	got := fs.RecordsByPartition()
+	gotOffsets := make(map[string]map[int32][]int64)
+	for topic, partitions := range got {
+		gotOffsets[topic] = make(map[int32][]int64)
+		for partition, records := range partitions {
+			for _, r := range records {
+				gotOffsets[topic][partition] = append(gotOffsets[topic][partition], r.Offset)
+			}
+		}
+	}
+	exp := map[string]map[int32][]int64{
+		"a": {0: {0, 1, 2}, 2: {5, 6, 7}},
+		"b": {0: {0}, 1: {3, 4}},
+	}
+	if !reflect.DeepEqual(gotOffsets, exp) {
+		t.Errorf("got %v != exp %v", gotOffsets, exp)
+	}
+	if spare := a2[:cap(a2)][len(a2)]; spare != nil {
+		t.Errorf("merging wrote into the fetched records backing array")
+	}
+
+	if got := (Fetches{}).RecordsByPartition(); got == nil || len(got) != 0 {
+		t.Errorf("got %v for no records, exp empty non-nil map", got)
+	}
+}
+
+func TestRecordIterStopOnErr(t *testing.T) {
+	collect := func(iter *FetchesRecordIter) []*Record {
+		var rs []*Record
+		for !iter.Done() {
+			rs = append(rs, iter.Next())
+		}
+		return rs
+	}
+
+	fs := testFetches()
+	all := collect(fs.RecordIter())
+	if got := collect(fs.RecordIterStopOnErr()); !reflect.DeepEqual(got, all) {
+		t.Errorf("with no errors, stop on err iter did not return all records")
+	}
+
+	fs[0].Topics[0].Partitions[2].Err = errors.New("parse failure")
+	if got := collect(fs.RecordIterStopOnErr()); !reflect.DeepEqual(got, all[:3]) {
+		t.Errorf("got %d records, exp the 3 records before the errored partition", len(got))
+	}
+
+	fs[0].Topics[0].Partitions[0].Err = errors.New("first")
+	if iter := fs.RecordIterStopOnErr(); !iter.Done() {
+		t.Errorf("iter not done with an error in the first partition")
+	}
+}
+
+func TestFetchesDeepCopy(t *testing.T) {
+	fs := testFetches()
+	fs[0].Topics[0].Partitions[1].Err = errors.New("err")
+	r := fs[0].Topics[0].Partitions[0].Records[0]
+	r.Key = []byte("k")
+	r.Headers = []RecordHeader{{"h", []byte("v")}}
+
+	cp := fs.DeepCopy()
+	if !reflect.DeepEqual(cp, fs) {
+		t.Fatal("copy is not equal to the original")
+	}
+
+	r.Key[0] = 'x'
+	r.Headers[0].Value[0] = 'x'
+	r.Offset = 100
+	if cpr := cp[0].Topics[0].Partitions[0].Records[0]; string(cpr.Key) != "k" || string(cpr.Headers[0].Value) != "v" || cpr.Offset != 0 {
+		t.Errorf("copy shares memory with the original: %#v", cpr)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	base := &Record{
+		Key:   []byte("k"),
+		Value: []byte("v"),
+		Headers: []RecordHeader{
+			{"a", []byte("1")},
+			{"b", []byte("2")},
+			{"a", []byte("0")},
+		},
+	}
+	h := base.ContentHash()
+
+	same := *base
+	same.Headers = []RecordHeader{base.Headers[2], base.Headers[1], base.Headers[0]}
+	same.Topic, same.Partition, same.Offset, same.LeaderEpoch = "other", 1, 100, 3
+	same.Timestamp = time.Now()
+	if same.ContentHash() != h {
+		t.Error("hash changed for same content with different header order and metadata")
+	}
+	if base.Headers[0].Key != "a" || string(base.Headers[0].Value) != "1" {
+		t.Error("hashing modified the record's header order")
+	}
+
+	distinct := []*Record{
+		{Key: []byte("k"), Value: []byte("v")},
+		{Key: []byte("kv")},
+		{Key: []byte("k"), Value: []byte{}},
+		{Key: []byte("k")},
+		{Key: []byte{}, Value: []byte("k")},
+		{Value: []byte("k")},
+	}
+	for i, r := range distinct {
+		for j, r2 := range distinct[i+1:] {
+			if r.ContentHash() == r2.ContentHash() {
+				t.Errorf("#%d and #%d unexpectedly have the same hash", i, i+1+j)
+			}
+		}
+	}
+}
+
+func TestFetchesErr(t *testing.T) {
+	fs := testFetches()
+	if err := fs.Err(); err != nil {
+		t.Errorf("got %v with no partition errors, exp nil", err)
+	}
+
+	err1, err2 := errors.New("one"), errors.New("two")
+	fs[0].Topics[0].Partitions[1].Err = err1
+	err := fs.Err()
+	var fe *FetchError
+	if !errors.As(err, &fe) || fe.Topic != "a" || fe.Partition != 1 || !errors.Is(err, err1) {
+		t.Errorf("got %v for one partition error, exp a *FetchError for a/1 wrapping %v", err, err1)
+	}
+
+	fs[1].Topics[0].Partitions[0].Err = err2
+	err = fs.Err()
+	multi, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(multi.Unwrap()) != 2 {
+		t.Fatalf("got %v for two partition errors, exp an error unwrapping to two errors", err)
+	}
+	for i, exp := range []error{err1, err2} {
+		if got := multi.Unwrap()[i]; !errors.Is(got, exp) {
+			t.Errorf("#%d: got %v, exp wrapped %v", i, got, exp)
+		}
+	}
+}
+
+func TestSplitPartitions(t *testing.T) {
+	fs := testFetches()
+	matched, rest := fs.SplitPartitions(func(topic string, partition int32) bool {
+		return topic == "b" || partition == 2
+	})
+
+	partitions := func(fs Fetches) []string {
+		var tps []string
+		fs.EachPartition(func(p FetchTopicPartition) {
+			tps = append(tps, fmt.Sprintf("%s/%d", p.Topic, p.Partition.Partition))
+		})
+		return tps
+	}
+	if got, exp := partitions(matched), []string{"a/2", "b/0", "b/1"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("matched: got %v != exp %v", got, exp)
+	}
+	if got, exp := partitions(rest), []string{"a/0", "a/1"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("rest: got %v != exp %v", got, exp)
+	}
+	if len(rest) != 1 {
+		t.Errorf("rest: got %d fetches, exp 1 (empty fetches should be dropped)", len(rest))
+	}
+}
+
+func TestSortedByTimestamp(t *testing.T) {
+	noTimestamp := RecordAttrs{0b1000_0000}
+	p := NewFetchPartition(0,
+		&Record{Offset: 0, Timestamp: time.Unix(5, 0)},
+		&Record{Offset: 1, Timestamp: time.Unix(3, 0)},
+		&Record{Offset: 2, Timestamp: time.Unix(9, 0), Attrs: noTimestamp},
+		&Record{Offset: 3, Timestamp: time.Unix(3, 0)},
+		&Record{Offset: 4, Timestamp: time.Unix(1, 0)},
+		&Record{Offset: 5, Attrs: noTimestamp},
+	)
+
+	var got []int64
+	for _, r := range p.SortedByTimestamp() {
+		got = append(got, r.Offset)
+	}
+	if exp := []int64{2, 5, 4, 1, 3, 0}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+	for i, r := range p.Records {
+		if r.Offset != int64(i) {
+			t.Errorf("original records were reordered")
+			break
+		}
+	}
+}
+
+func TestRecordIterSince(t *testing.T) {
+	fs := testFetches()
+	noTimestamp := RecordAttrs{0b1000_0000}
+	var i int64
+	fs.EachRecord(func(r *Record) {
+		r.Timestamp = time.Unix(i, 0)
+		if i == 4 {
+			r.Attrs = noTimestamp
+		}
+		i++
+	})
+
+	for _, test := range []struct {
+		cutoff int64
+		exp    []int64 // timestamp seconds
+	}{
+		{0, []int64{0, 1, 2, 3, 5, 6, 7}},
+		{3, []int64{3, 5, 6, 7}},
+		{7, []int64{7}},
+		{8, nil},
+	} {
+		var got []int64
+		for iter := fs.RecordIterSince(time.Unix(test.cutoff, 0)); !iter.Done(); {
+			got = append(got, iter.Next().Timestamp.Unix())
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("cutoff %d: got %v != exp %v", test.cutoff, got, test.exp)
+		}
+	}
+}
+
+func TestHeaderInt(t *testing.T) {
+	r := &Record{Headers: []RecordHeader{
+		{"i8", []byte{0xff}},
+		{"i16", []byte{0x01, 0x02}},
+		{"i32", []byte{0x80, 0, 0, 0}},
+		{"i64", []byte{0, 0, 0, 0, 0, 0, 0x01, 0x00}},
+		{"odd", []byte{1, 2, 3}},
+		{"dup", []byte{1}},
+		{"dup", []byte{2}},
+	}}
+	for _, test := range []struct {
+		key string
+		exp int64
+		ok  bool
+	}{
+		{"i8", -1, true},
+		{"i16", 0x0102, true},
+		{"i32", -1 << 31, true},
+		{"i64", 256, true},
+		{"odd", 0, false},
+		{"missing", 0, false},
+		{"dup", 2, true},
+	} {
+		got, ok := r.HeaderInt(test.key)
+		if got != test.exp || ok != test.ok {
+			t.Errorf("%s: got (%d, %v) != exp (%d, %v)", test.key, got, ok, test.exp, test.ok)
+		}
+	}
+
+	if got, ok := r.HeaderString("odd"); got != "\x01\x02\x03" || !ok {
+		t.Errorf("got (%q, %v) for existing string header", got, ok)
+	}
+	if _, ok := r.HeaderString("missing"); ok {
+		t.Error("found missing string header")
+	}
+}
+
+func TestEstimateRate(t *testing.T) {
+	noTimestamp := RecordAttrs{0b1000_0000}
+	for i, test := range []struct {
+		records []*Record
+		rate    float64
+		ok      bool
+	}{
+		{nil, 0, false},
+		{[]*Record{{Timestamp: time.Unix(1, 0)}}, 0, false},
+		{[]*Record{{Timestamp: time.Unix(1, 0)}, {Timestamp: time.Unix(1, 0)}}, 0, false},
+		{[]*Record{{Timestamp: time.Unix(1, 0)}, {Timestamp: time.Unix(9, 0), Attrs: noTimestamp}}, 0, false},
+		{[]*Record{{Timestamp: time.Unix(3, 0)}, {Timestamp: time.Unix(1, 0)}, {Timestamp: time.Unix(2, 0)}, {Attrs: noTimestamp}}, 1.5, true},
+	} {
+		fs := NewFetches(NewFetchTopic("t", NewFetchPartition(0, test.records...)))
+		rate, ok := fs.EstimateRate()
+		if rate != test.rate || ok != test.ok {
+			t.Errorf("#%d: got (%v, %v) != exp (%v, %v)", i, rate, ok, test.rate, test.ok)
+		}
+	}
+}
+
+func TestRecordsInRange(t *testing.T) {
+	var rs []*Record
+	for _, o := range []int64{3, 5, 6, 9, 10} {
+		rs = append(rs, &Record{Offset: o})
+	}
+	p := NewFetchPartition(0, rs...)
+	for _, test := range []struct {
+		lo, hi int64
+		exp    []int64
+	}{
+		{0, 100, []int64{3, 5, 6, 9, 10}},
+		{4, 10, []int64{5, 6, 9}},
+		{5, 6, []int64{5}},
+		{7, 9, nil},
+		{11, 20, nil},
+		{6, 6, nil},
+		{9, 5, nil},
+	} {
+		var got []int64
+		for _, r := range p.RecordsInRange(test.lo, test.hi) {
+			got = append(got, r.Offset)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("[%d, %d): got %v != exp %v", test.lo, test.hi, got, test.exp)
+		}
+	}
+}
+
+func TestPayloadEqual(t *testing.T) {
+	base := &Record{
+		Key:     []byte("k"),
+		Value:   []byte("v"),
+		Headers: []RecordHeader{{"a", []byte("1")}, {"b", nil}},
+	}
+	same := *base
+	same.Key = []byte("k")
+	same.Topic, same.Partition, same.Offset, same.ProducerID = "t", 1, 10, 3
+	same.Timestamp = time.Now()
+	if !base.PayloadEqual(&same) {
+		t.Error("records with the same payload and different metadata are not equal")
+	}
+
+	for i, diff := range []func(r *Record){
+		func(r *Record) { r.Key = []byte("x") },
+		func(r *Record) { r.Key = nil },
+		func(r *Record) { r.Value = []byte{} },
+		func(r *Record) { r.Headers = r.Headers[:1] },
+		func(r *Record) { r.Headers = []RecordHeader{r.Headers[1], r.Headers[0]} },
+		func(r *Record) { r.Headers = []RecordHeader{r.Headers[0], {"b", []byte{}}} },
+	} {
+		other := *base
+		diff(&other)
+		if base.PayloadEqual(&other) || other.PayloadEqual(base) {
+			t.Errorf("#%d: records with different payloads are equal", i)
+		}
+	}
+}
+
+func TestRecordIterCollect(t *testing.T) {
+	fs := testFetches()
+	var all []*Record
+	fs.EachRecord(func(r *Record) { all = append(all, r) })
+
+	if got := fs.Records(); !reflect.DeepEqual(got, all) || cap(got) != len(all) {
+		t.Errorf("Records: got %d records (cap %d), exp %d", len(got), cap(got), len(all))
+	}
+
+	for skip := 0; skip <= len(all); skip++ {
+		iter := fs.RecordIter()
+		for i := 0; i < skip; i++ {
+			iter.Next()
+		}
+		got := iter.Collect()
+		if !reflect.DeepEqual(got, all[skip:]) || cap(got) != len(all)-skip {
+			t.Errorf("skip %d: got %d records (cap %d), exp %d", skip, len(got), cap(got), len(all)-skip)
+		}
+		if !iter.Done() {
+			t.Errorf("skip %d: iter not done after collect", skip)
+		}
+		if got := iter.Collect(); got == nil || len(got) != 0 {
+			t.Errorf("skip %d: second collect got %v, exp empty slice", skip, got)
+		}
+	}
+}
+
+func TestDominantCodec(t *testing.T) {
+	codecs := func(types ...uint8) FetchPartition {
+		var rs []*Record
+		for _, typ := range types {
+			rs = append(rs, &Record{Attrs: RecordAttrs{typ}})
+		}
+		return NewFetchPartition(0, rs...)
+	}
+	for i, test := range []struct {
+		p     FetchPartition
+		codec CompressionCodec
+		ok    bool
+	}{
+		{codecs(), NoCompression(), false},
+		{codecs(0, 0), NoCompression(), true},
+		{codecs(4, 4|0b0001_0000), ZstdCompression(), true}, // other attrs are ignored
+		{codecs(1), GzipCompression(), true},
+		{codecs(2, 3), NoCompression(), false},
+		{codecs(7), NoCompression(), false},
+	} {
+		codec, ok := test.p.DominantCodec()
+		if codec != test.codec || ok != test.ok {
+			t.Errorf("#%d: got (%v, %v) != exp (%v, %v)", i, codec, ok, test.codec, test.ok)
+		}
+	}
+}
+
+func TestPendingTransactionGap(t *testing.T) {
+	fs := NewFetches(NewFetchTopic("t",
+		NewFetchPartition(0).WithWatermarks(0, 90, 100),
+		NewFetchPartition(1).WithWatermarks(0, 100, 100),
+		NewFetchPartition(2).WithWatermarks(0, -1, 1000), // fetch < v4: unknown LSO
+		NewFetchPartition(3).WithErr(errors.New("auth")),
+		NewFetchPartition(4, &Record{Offset: 3}, &Record{Offset: 4}).WithWatermarks(3, 5, 8).WithErr(errors.New("invalid crc")), // records before a parse error
+	))
+	fs = append(fs, NewFetches(NewFetchTopic("t",
+		NewFetchPartition(0).WithErr(&ErrDataLoss{Topic: "t"}), // must not overwrite the real gap
+	))...)
+
+	exp := map[TopicPartition]int64{
+		{"t", 0}: 10,
+		{"t", 1}: 0,
+		{"t", 4}: 3,
+	}
+	if got := fs.PendingTransactionGap(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}
+
+func TestPositions2(t *testing.T) {
+	fs := testFetches()
+	fs[0].Topics[0].Partitions[1].LogStartOffset = 4 // a/1 has no records
+	fs = append(fs, NewFetches(
+		NewFetchTopic("a", NewFetchPartition(2).WithWatermarks(3, 7, 7)), // lower than a/2's records
+		NewFetchTopic("t",
+			NewFetchPartition(0).WithWatermarks(-1, -1, -1),
+			NewFetchPartition(1).WithWatermarks(-1, -1, -1).WithErr(errors.New("auth")),
+			NewFetchPartition(3).WithErr(&ErrDataLoss{Topic: "t", Partition: 3}),
+			NewFetchPartition(4, &Record{Offset: 8}, &Record{Offset: 9}).WithErr(errors.New("invalid crc")), // records before a parse error
+		),
+	)...)
+
+	exp := map[TopicPartition]int64{
+		{"a", 0}: 3,
+		{"a", 1}: 4,
+		{"a", 2}: 7,
+		{"b", 0}: 1,
+		{"b", 1}: 5,
+		{"t", 4}: 10,
+	}
+	if got := fs.Positions2(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}
+
+func TestLSOGap(t *testing.T) {
+	for _, test := range []struct {
+		lso, hwm int64
+		exp      int64
+	}{
+		{90, 100, 10},
+		{100, 100, 0},
+		{-1, 1000, 0}, // fetch < v4: unknown LSO
+	} {
+		if got := NewFetchPartition(0).WithWatermarks(0, test.lso, test.hwm).LSOGap(); got != test.exp {
+			t.Errorf("lso %d hwm %d: got %d != exp %d", test.lso, test.hwm, got, test.exp)
+		}
+	}
+}
+
+func TestCaughtUpPartitions(t *testing.T) {
+	fs := NewFetches(
+		NewFetchTopic("a",
+			NewFetchPartition(0, &Record{Offset: 0}, &Record{Offset: 1}),                      // last record at HWM-1
+			NewFetchPartition(1, &Record{Offset: 5}).WithWatermarks(5, 10, 10),                // behind
+			NewFetchPartition(2).WithWatermarks(4, 4, 4),                                      // empty
+			NewFetchPartition(3).WithWatermarks(0, 2, 2),                                      // no records, not empty
+			NewFetchPartition(4).WithErr(errors.New("auth")),                                  // zero watermarks
+			NewFetchPartition(5).WithWatermarks(-1, -1, -1).WithErr(errors.New("some error")), // -1 watermarks
+		),
+	)
+	var got []int32
+	for _, p := range fs.CaughtUpPartitions() {
+		got = append(got, p.Partition.Partition)
+	}
+	if exp := []int32{0, 2}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v != exp %v", got, exp)
+	}
+}